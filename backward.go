@@ -0,0 +1,150 @@
+package pen
+
+import (
+	"bytes"
+	"io"
+	"math"
+)
+
+// how much is read at once while looking for the previous header
+const backwardWindow = 64 << 10
+
+// ScanBackward calls cb for the records that start before from, newest first. Use math.MaxUint32 to start from the end of the file.
+// Since the headers only say where the next record is, it looks backwards for a header (MAGIC and a valid header checksum)
+// of a record that ends at or before the start of the previous one, and verifies it. Corrupted regions in between are skipped
+// like Scan skips them (see ScanOptions.OnCorruption), deleted records are skipped too (see ScanOptions.OnDeleted).
+// from does not have to be a record boundary, the record it falls into is the first one returned
+func (ar *Reader) ScanBackward(from uint32, cb func([]byte, uint32, uint32) error) error {
+	return ar.ScanBackwardWithOptions(from, ScanOptions{}, cb)
+}
+
+// Same as ScanBackward, with options (ReadAhead and Prefetch are ignored)
+func (ar *Reader) ScanBackwardWithOptions(from uint32, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	st, err := ar.file.Stat()
+	if err != nil {
+		return err
+	}
+	return ar.format.scanBackward(ar.file, st.Size(), from, ar.blockSize, opts, cb)
+}
+
+func (f *format) scanBackward(reader io.ReaderAt, size int64, from uint32, blockSize int, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	// the last record is not padded, so the end of the file rounded up is the next of the last record
+	fileEnd := (size + int64(f.pad) - 1) / int64(f.pad)
+	if fileEnd > math.MaxUint32 {
+		fileEnd = math.MaxUint32
+	}
+	end := fileEnd
+	if int64(from) < end {
+		end = int64(from)
+	}
+	// until the first record is found it may extend past end, when from is in the middle of it
+	first := true
+
+	var window []byte
+	windowStart := int64(0)
+	var out []byte
+
+	stats := ScanStats{}
+	if opts.Stats != nil {
+		defer func() {
+			*opts.Stats = stats
+		}()
+	}
+	// the region between the end of a record and the start of the one after it
+	corrupted := func(start, end uint32) error {
+		if opts.Strict {
+			return &CorruptionError{Offset: start}
+		}
+		stats.Corrupted++
+		stats.CorruptedBytes += f.position(end) - f.position(start)
+		if opts.OnCorruption != nil {
+			opts.OnCorruption(start, end, EBADSLT)
+		}
+		return nil
+	}
+
+	for candidate := end - 1; candidate >= int64(f.start); candidate-- {
+		position := f.position(uint32(candidate))
+		if position < windowStart || position+16 > windowStart+int64(len(window)) {
+			windowEnd := position + 16
+			windowStart = windowEnd - backwardWindow
+			if windowStart < f.position(f.start) {
+				windowStart = f.position(f.start)
+			}
+			if window == nil {
+				window = make([]byte, backwardWindow)
+			}
+			n, err := reader.ReadAt(window[:windowEnd-windowStart], windowStart)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			window = window[:n]
+		}
+
+		header := window[position-windowStart:]
+		if len(header) < 16 || !bytes.Equal(header[8:12], f.magic) {
+			continue
+		}
+		fr, err := f.parseHeader(header[:16])
+		if err != nil {
+			continue
+		}
+		next := candidate + int64(f.units(int(fr.length)))
+		if fr.flags&flagSkip != 0 {
+			next = candidate + int64(fr.length)
+		}
+		if fr.flags&flagSkip != 0 && next > fileEnd {
+			// the hole at the tail was reserved but never written, so the file ends before it
+			next = fileEnd
+		}
+		if next > end && (!first || next > fileEnd) {
+			// it would overlap records that are already returned
+			continue
+		}
+
+		fr, _, err = f.frameAt(reader, uint32(candidate), blockSize)
+		if err == EBADSLT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if next < end {
+			err = corrupted(uint32(next), uint32(end))
+			if err != nil {
+				return err
+			}
+		}
+		switch {
+		case fr.flags&flagSkip != 0:
+		case fr.flags&flagDeleted != 0:
+			stats.Deleted++
+			if opts.OnDeleted != nil {
+				err = opts.OnDeleted(uint32(candidate), uint32(next))
+			}
+		case opts.ReuseBuffer:
+			stats.Records++
+			out, err = decompressInto(out, fr.data, fr.flags)
+			if err == nil {
+				err = cb(out, uint32(candidate), uint32(next))
+			}
+		default:
+			stats.Records++
+			var data []byte
+			data, err = decompress(fr.data, fr.flags)
+			if err == nil {
+				err = cb(data, uint32(candidate), uint32(next))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		end = candidate
+		first = false
+	}
+	if end > int64(f.start) {
+		return corrupted(f.start, uint32(end))
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package pen
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestScanBackward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Superblock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	offsets := []uint32{}
+	for i := 0; i < 500; i++ {
+		size := (i * 37) % 3000
+		if i%100 == 50 {
+			// bigger than the window
+			size = 3 * backwardWindow
+		}
+		off, _, err := fw.Append([]byte(RandStringRunes(size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+
+		if i%97 == 0 {
+			// hole left by a failed append
+			hole, err := fw.reserve(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.fillHole(hole, 10)
+		}
+	}
+	for i := 10; i < 500; i += 40 {
+		err = fw.Delete(offsets[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fw.Overwrite(offsets[i+1], []byte("short"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.file.WriteAt([]byte("garbage"), fw.format.position(offsets[i+2])+5)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	mr, err := NewMmapReader(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	expected := []Case{}
+	deleted := 0
+	err = r.ScanWithOptions(0, ScanOptions{OnDeleted: func(offset, next uint32) error {
+		deleted++
+		return nil
+	}}, func(data []byte, offset, next uint32) error {
+		expected = append(expected, Case{document: offset, next: next, data: data})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reader := range []RecordReader{r, mr} {
+		for _, from := range []int{len(expected), len(expected) / 2, 0} {
+			to := uint32(math.MaxUint32)
+			if from < len(expected) {
+				to = expected[from].document
+			}
+
+			i := from
+			deletedBackward := 0
+			err = reader.ScanBackwardWithOptions(to, ScanOptions{OnDeleted: func(offset, next uint32) error {
+				deletedBackward++
+				return nil
+			}}, func(data []byte, offset, next uint32) error {
+				i--
+				v := expected[i]
+				if offset != v.document || next != v.next || !bytes.Equal(data, v.data) {
+					t.Fatalf("mismatch at %d, expected %d", offset, v.document)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i != 0 {
+				t.Fatalf("expected all records before %d, missing %d", to, i)
+			}
+			if from == len(expected) && deletedBackward != deleted {
+				t.Fatalf("expected %d deleted got %d", deleted, deletedBackward)
+			}
+		}
+	}
+
+	// stops early
+	stop := errors.New("stop")
+	n := 0
+	err = r.ScanBackward(math.MaxUint32, func(data []byte, offset, next uint32) error {
+		n++
+		if n == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || n != 3 {
+		t.Fatalf("expected stop after 3, got %v after %d", err, n)
+	}
+}
+
+func TestScanBackwardTailHoleAndMidRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	first, _, err := fw.Append([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(RandStringRunes(1000))
+	off, next, err := fw.Append(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the hole is at the tail, only its header is in the file
+	hole, err := fw.reserve(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.fillHole(hole, 100)
+
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	mr, err := NewMmapReader(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	for _, reader := range []RecordReader{r, mr} {
+		for _, from := range []uint32{math.MaxUint32, off + (next-off)/2} {
+			corrupted := 0
+			offsets := []uint32{}
+			err = reader.ScanBackwardWithOptions(from, ScanOptions{OnCorruption: func(start, end uint32, err error) {
+				corrupted++
+			}}, func(data []byte, offset, next uint32) error {
+				offsets = append(offsets, offset)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if corrupted != 0 {
+				t.Fatalf("from %d: expected no corruption got %d", from, corrupted)
+			}
+			if len(offsets) != 2 || offsets[0] != off || offsets[1] != first {
+				t.Fatalf("from %d: expected [%d %d] got %v", from, off, first, offsets)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package pen
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// Counters of the Reader cache, see ReaderOptions.CacheBytes
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// how much data is cached, and in how many records
+	Bytes   int
+	Entries int
+}
+
+type cacheEntry struct {
+	offset uint32
+	next   uint32
+	data   []byte
+}
+
+// LRU of verified and decompressed records, bounded by the size of their data
+type recordCache struct {
+	// the cached file, Writers of the same file invalidate what they overwrite
+	info os.FileInfo
+	max  int
+
+	lock    sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[uint32]*list.Element
+	// bumped by every invalidation, so a record read before it is not cached after it
+	generation uint64
+	hits       uint64
+	misses     uint64
+}
+
+func newRecordCache(info os.FileInfo, max int) *recordCache {
+	return &recordCache{
+		info:    info,
+		max:     max,
+		lru:     list.New(),
+		entries: map[uint32]*list.Element{},
+	}
+}
+
+// returns the cached record, or on miss the generation to pass to put after reading it
+func (c *recordCache) get(offset uint32) ([]byte, uint32, uint64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[offset]
+	if !ok {
+		c.misses++
+		return nil, 0, c.generation, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*cacheEntry)
+	return entry.data, entry.next, 0, true
+}
+
+func (c *recordCache) put(offset, next uint32, data []byte, generation uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if generation != c.generation || len(data) > c.max {
+		return
+	}
+	if e, ok := c.entries[offset]; ok {
+		c.remove(e)
+	}
+	c.entries[offset] = c.lru.PushFront(&cacheEntry{offset: offset, next: next, data: data})
+	c.size += len(data)
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *recordCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.offset)
+	c.size -= len(entry.data)
+}
+
+func (c *recordCache) invalidate(offset uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.generation++
+	if e, ok := c.entries[offset]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *recordCache) stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Bytes: c.size, Entries: c.lru.Len()}
+}
+
+// caches of the open Readers, so Writers in the same process can invalidate what they overwrite
+var caches struct {
+	sync.Mutex
+	list []*recordCache
+}
+
+func registerCache(c *recordCache) {
+	caches.Lock()
+	defer caches.Unlock()
+	caches.list = append(caches.list, c)
+}
+
+func unregisterCache(c *recordCache) {
+	caches.Lock()
+	defer caches.Unlock()
+	for i, v := range caches.list {
+		if v == c {
+			caches.list = append(caches.list[:i], caches.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// called by the Writer after it modified the record at offset
+func invalidateCaches(info os.FileInfo, offset uint32) {
+	caches.Lock()
+	defer caches.Unlock()
+	for _, c := range caches.list {
+		if os.SameFile(c.info, info) {
+			c.invalidate(offset)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReaderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	reader, err := NewReaderWithOptions(fn, ReaderOptions{CacheBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	cases := []Case{}
+	for i := 0; i < 100; i++ {
+		data := []byte(RandStringRunes(100))
+		off, next, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+	}
+
+	for k := 0; k < 2; k++ {
+		data, next, err := reader.Read(cases[0].document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != cases[0].next || !bytes.Equal(data, cases[0].data) {
+			t.Fatal("mismatch")
+		}
+		// the cached copy can not be modified through the result
+		data[0] = '!'
+	}
+	stats := reader.CacheStats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 || stats.Bytes != 100 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// the entry holds only the record, not the block it was read from
+	entry := reader.cache.entries[cases[0].document].Value.(*cacheEntry)
+	if cap(entry.data) >= 2*len(cases[0].data) {
+		t.Fatalf("cached entry pins %d bytes for a %d byte record", cap(entry.data), len(cases[0].data))
+	}
+
+	// the writer invalidates what it overwrites, also when it opened the file on its own
+	other, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	for _, w := range []*Writer{fw, other} {
+		err = w.Overwrite(cases[0].document, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, err := reader.Read(cases[0].document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello" {
+			t.Fatalf("expected hello got %s", data)
+		}
+		err = w.Overwrite(cases[0].document, []byte("world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, err = reader.Read(cases[0].document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "world" {
+			t.Fatalf("expected world got %s", data)
+		}
+	}
+
+	err = fw.Delete(cases[0].document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = reader.Read(cases[0].document)
+	if err != ErrDeleted {
+		t.Fatalf("expected ErrDeleted got %v", err)
+	}
+
+	// only the last 10 records fit
+	var buf []byte
+	for _, v := range cases[1:] {
+		buf, _, err = reader.ReadInto(v.document, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, v.data) {
+			t.Fatalf("mismatch at %d", v.document)
+		}
+	}
+	stats = reader.CacheStats()
+	if stats.Entries != 10 || stats.Bytes != 1000 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	before := stats.Hits
+	for _, v := range cases[len(cases)-10:] {
+		_, _, err = reader.Read(v.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reader.CacheStats().Hits != before+10 {
+		t.Fatalf("expected hits, got %+v", reader.CacheStats())
+	}
+}
@@ -0,0 +1,277 @@
+package pen
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Options for Compact
+type CompactOptions struct {
+	// blockSize for reading the old file, see NewReader
+	BlockSize int
+
+	// Checksum algorithm for files without superblock, see ReaderOptions
+	Hasher Hasher
+
+	// Where to store the old -> new offset mapping, "" means filename + ".remap"
+	RemapFile string
+}
+
+// Remap is the old -> new offset mapping produced by Compact
+type Remap struct {
+	from []uint32
+	to   []uint32
+
+	// size and CRC32-C of the compacted file, see Matches
+	size     int64
+	checksum uint32
+}
+
+// Lookup the new offset of a record, false if the record did not survive the compaction
+func (r *Remap) Lookup(old uint32) (uint32, bool) {
+	i := sort.Search(len(r.from), func(i int) bool { return r.from[i] >= old })
+	if i < len(r.from) && r.from[i] == old {
+		return r.to[i], true
+	}
+	return 0, false
+}
+
+// Matches tells if filename is the file this mapping was written for, as Compact left it (same size and checksum).
+// After a crash check it before using a leftover remap file: if Compact did not get to rename the compacted file
+// in place the old file is still there, and the mapping does not apply to it
+func (r *Remap) Matches(filename string) (bool, error) {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	st, err := fd.Stat()
+	if err != nil {
+		return false, err
+	}
+	if st.Size() != r.size {
+		return false, nil
+	}
+	checksum, err := fileChecksum(fd)
+	if err != nil {
+		return false, err
+	}
+	return checksum == r.checksum, nil
+}
+
+func fileChecksum(fd *os.File) (uint32, error) {
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	_, err := io.Copy(h, io.NewSectionReader(fd, 0, math.MaxInt64))
+	return h.Sum32(), err
+}
+
+// Amount of records in the mapping
+func (r *Remap) Len() int {
+	return len(r.from)
+}
+
+// Compact rewrites filename keeping only the live records: deleted, corrupted and skipped space is dropped
+// and so is the slack left by Overwrite with smaller data. The records are copied as they are stored (compression
+// is kept) and the superblock is preserved.
+// The old -> new offset mapping is written to CompactOptions.RemapFile (read it with OpenRemap) before the new
+// file is renamed over the old one, so you can fix your external indexes. After a crash use Remap.Matches to tell
+// if a leftover mapping belongs to the file.
+//
+// This is offline compaction, nobody should be writing to the file while it runs, and all Writers/Readers
+// have to be reopened after. If it returns error the original file is untouched (except that a pending
+// SafeOverwrite journal is replayed first, same as NewWriter does).
+func Compact(filename string, opts CompactOptions) (*Remap, error) {
+	remapFile := opts.RemapFile
+	if remapFile == "" {
+		remapFile = filename + ".remap"
+	}
+
+	reader, err := NewReaderWithOptions(filename, ReaderOptions{BlockSize: opts.BlockSize, Hasher: opts.Hasher})
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// the journal points at byte positions in the old layout, replay it now because it is meaningless after
+	err = compactJournal(filename, reader.format)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := filename + ".compact"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer fd.Close()
+
+	fw := &Writer{file: fd, offset: reader.format.start, format: reader.format}
+	if reader.format.start > 0 {
+		_, err = fd.WriteAt(reader.format.encodeSuperblock(), 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	remap := &Remap{}
+	err = reader.format.scanFrames(reader.file, 0, reader.blockSize, ScanOptions{}, func(fr frame, offset, next uint32) error {
+		newOffset, _, err := fw.appendStored(fr.data, fr.flags)
+		if err != nil {
+			return err
+		}
+		remap.from = append(remap.from, offset)
+		remap.to = append(remap.to, newOffset)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = fd.Sync()
+	if err != nil {
+		return nil, err
+	}
+	st, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	remap.size = st.Size()
+	remap.checksum, err = fileChecksum(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	err = remap.write(remapFile, reader.format.hasher)
+	if err != nil {
+		return nil, err
+	}
+	// the mapping has to be on disk before the compacted file is, otherwise the indexes can not be fixed after a crash
+	err = syncDir(filepath.Dir(remapFile))
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(filename + ".journal")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return nil, err
+	}
+	return remap, syncDir(filepath.Dir(filename))
+}
+
+// replays the SafeOverwrite journal of filename, if there is one
+func compactJournal(filename string, f format) error {
+	_, err := os.Stat(filename + ".journal")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(filename, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return f.replayJournal(fd)
+}
+
+// writes the mapping with FixedWriteAt, and renames it in place. The first entry is 8 bytes LE size of the compacted file,
+// the second 4 bytes LE CRC32-C of it and 4 zero bytes, then 4 bytes LE old + 4 bytes LE new offset per entry
+func (r *Remap) write(filename string, hasher Hasher) error {
+	tmp := filename + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer fd.Close()
+
+	// same layout as FixedWriteAt, but in one write
+	blob := make([]byte, (remapHeaderEntries+len(r.from))*(FixedHeaderSize+8))
+	for i := 0; i < remapHeaderEntries+len(r.from); i++ {
+		block := blob[i*(FixedHeaderSize+8):]
+		entry := block[FixedHeaderSize : FixedHeaderSize+8]
+		switch i {
+		case 0:
+			binary.LittleEndian.PutUint64(entry, uint64(r.size))
+		case 1:
+			binary.LittleEndian.PutUint32(entry, r.checksum)
+		default:
+			binary.LittleEndian.PutUint32(entry, r.from[i-remapHeaderEntries])
+			binary.LittleEndian.PutUint32(entry[4:], r.to[i-remapHeaderEntries])
+		}
+		binary.LittleEndian.PutUint64(block, hasher.Sum64(entry))
+	}
+	_, err = fd.Write(blob)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// the size and checksum of the compacted file, in front of the mapping
+const remapHeaderEntries = 2
+
+// Opens the mapping written by Compact, hasher has to be the one of the compacted file (nil means MetroHasher)
+func OpenRemap(filename string, hasher Hasher) (*Remap, error) {
+	if hasher == nil {
+		hasher = MetroHasher
+	}
+	fd, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	n, err := FixedLen(fd, 8)
+	if err != nil {
+		return nil, err
+	}
+	if n < remapHeaderEntries {
+		return nil, EBADSLT
+	}
+
+	r := &Remap{from: make([]uint32, n-remapHeaderEntries), to: make([]uint32, n-remapHeaderEntries)}
+	entry := make([]byte, 8)
+	for i := uint64(0); i < n; i++ {
+		err = FixedReadAtWithHasher(fd, i, entry, hasher)
+		if err != nil {
+			return nil, err
+		}
+		switch i {
+		case 0:
+			r.size = int64(binary.LittleEndian.Uint64(entry))
+		case 1:
+			r.checksum = binary.LittleEndian.Uint32(entry)
+		default:
+			r.from[i-remapHeaderEntries] = binary.LittleEndian.Uint32(entry)
+			r.to[i-remapHeaderEntries] = binary.LittleEndian.Uint32(entry[4:])
+		}
+	}
+	return r, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
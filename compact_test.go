@@ -0,0 +1,217 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Superblock: true, Hasher: XXHasher, Compression: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []Case{}
+	deleted := map[uint32]bool{}
+	for i := 0; i < 300; i++ {
+		data := []byte(RandStringRunes(i))
+		if i%5 == 0 {
+			data = []byte(strings.Repeat("compress me ", i))
+		}
+		off, _, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch i % 3 {
+		case 0:
+			err = fw.Delete(off)
+			deleted[off] = true
+		case 1:
+			data = data[:len(data)/2]
+			err = fw.Overwrite(off, data)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, data: data})
+	}
+	fw.Close()
+
+	before, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remap, err := Compact(fn, CompactOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remap.Len() != len(cases)-len(deleted) {
+		t.Fatalf("expected %d got %d", len(cases)-len(deleted), remap.Len())
+	}
+
+	after, err := os.Stat(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size()*3/4 {
+		t.Fatalf("expected smaller file, before: %d after: %d", before.Size(), after.Size())
+	}
+
+	persisted, err := OpenRemap(fn+".remap", XXHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []*Remap{remap, persisted} {
+		ok, err := r.Matches(fn)
+		if err != nil || !ok {
+			t.Fatalf("expected the mapping to match the compacted file, got %v %v", ok, err)
+		}
+	}
+
+	reader, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for _, v := range cases {
+		newOffset, ok := remap.Lookup(v.document)
+		if deleted[v.document] {
+			if ok {
+				t.Fatalf("deleted record %d is still there", v.document)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("missing %d", v.document)
+		}
+		persistedOffset, ok := persisted.Lookup(v.document)
+		if !ok || persistedOffset != newOffset {
+			t.Fatalf("expected %d got %d", newOffset, persistedOffset)
+		}
+
+		data, _, err := reader.Read(newOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v.data, data) {
+			t.Fatalf("data mismatch, expected %s got %s", v.data, data)
+		}
+	}
+
+	// a leftover mapping does not match another file, even of the same size
+	compacted, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range [][]byte{make([]byte, before.Size()), append([]byte{^compacted[0]}, compacted[1:]...)} {
+		err = ioutil.WriteFile(fn+".old", other, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := persisted.Matches(fn + ".old")
+		if err != nil || ok {
+			t.Fatalf("expected no match, got %v %v", ok, err)
+		}
+	}
+
+	// the superblock survived
+	if reader.format.start == 0 || reader.format.hasher != XXHasher {
+		t.Fatal("expected superblock")
+	}
+
+	_, err = os.Stat(fn + ".compact")
+	if !os.IsNotExist(err) {
+		t.Fatal("expected the temporary file to be gone")
+	}
+}
+
+func TestCompactReplaysJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, _, err := fw.Append([]byte(RandStringRunes(1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	off, _, err := fw.Append([]byte(RandStringRunes(1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _, err := fw.Append([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fw.Delete(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SafeOverwrite that crashed after the journal, with a torn write in place
+	newValue := []byte(RandStringRunes(900))
+	blob := make([]byte, 16+len(newValue))
+	fw.format.putFrame(blob, newValue, 0)
+	err = fw.writeJournal(int64(off*PAD), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.file.WriteAt(blob[:16], int64(off*PAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Close()
+
+	remap, err := Compact(fn, CompactOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(fn + ".journal")
+	if !os.IsNotExist(err) {
+		t.Fatal("expected the journal to be gone")
+	}
+
+	// the journal is not replayed again over the new layout
+	fw, err = NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	reader, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	for old, expected := range map[uint32][]byte{off: newValue, after: []byte("after")} {
+		newOffset, ok := remap.Lookup(old)
+		if !ok {
+			t.Fatalf("missing %d", old)
+		}
+		data, _, err := reader.Read(newOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("data mismatch at %d", old)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package pen
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression used for new records, it is stored per record so files can mix compressed and raw records
+type Compression uint8
+
+const (
+	NoCompression Compression = iota
+	// compress/flate with flate.BestSpeed
+	Deflate
+)
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// returns the bytes to store and the header flags for them
+// if compression does not make the data smaller it is stored raw
+func compress(c Compression, encoded []byte) ([]byte, uint32) {
+	if c != Deflate || len(encoded) == 0 {
+		return encoded, 0
+	}
+
+	var out bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&out)
+	if _, err := w.Write(encoded); err != nil {
+		return encoded, 0
+	}
+	if err := w.Close(); err != nil {
+		return encoded, 0
+	}
+	if out.Len() >= len(encoded) {
+		return encoded, 0
+	}
+	return out.Bytes(), flagCompressed
+}
+
+// returns the data as it was given to Append
+func decompress(stored []byte, flags uint32) ([]byte, error) {
+	if flags&flagCompressed == 0 {
+		return stored, nil
+	}
+
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	err := r.(flate.Resetter).Reset(bytes.NewReader(stored), nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// same as decompress, but the data is always copied into dst (grown if needed)
+func decompressInto(dst []byte, stored []byte, flags uint32) ([]byte, error) {
+	if flags&flagCompressed == 0 {
+		return append(dst[:0], stored...), nil
+	}
+
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	err := r.(flate.Resetter).Reset(bytes.NewReader(stored), nil)
+	if err != nil {
+		return nil, err
+	}
+	out := bytes.NewBuffer(dst[:0])
+	_, err = out.ReadFrom(r)
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,177 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	compressed, err := NewWriterWithOptions(fn, WriterOptions{Compression: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+	raw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	// both writers share the file, so move the raw one after the compressed one every time
+	reader, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	cases := []Case{}
+	for i := 0; i < 100; i++ {
+		data := []byte(strings.Repeat(`{"hello":"world"}`, i))
+		off, next, err := compressed.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.offset = next
+		cases = append(cases, Case{document: off, next: next, data: data})
+
+		data = []byte(RandStringRunes(i))
+		off, next, err = raw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed.offset = next
+		cases = append(cases, Case{document: off, next: next, data: data})
+	}
+
+	for _, v := range cases {
+		data, next, err := reader.Read(v.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != v.next {
+			t.Fatalf("expected %d got %d", v.next, next)
+		}
+		if !bytes.Equal(v.data, data) {
+			t.Fatalf("data mismatch, expected %s got %s", v.data, data)
+		}
+	}
+
+	n := 0
+	err = reader.Scan(0, func(data []byte, offset, next uint32) error {
+		if !bytes.Equal(cases[n].data, data) {
+			t.Fatalf("data mismatch, expected %s got %s", cases[n].data, data)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cases) {
+		t.Fatalf("expected %d got %d", len(cases), n)
+	}
+
+	// stored compressed, so overwriting with something that compresses well fits
+	big := []byte(strings.Repeat("a", 4096))
+	off, _, err := compressed.Append(big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressed.Overwrite(off, []byte(strings.Repeat("b", 4096)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := reader.Read(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte(strings.Repeat("b", 4096))) {
+		t.Fatal("mismatch")
+	}
+	err = compressed.Overwrite(off, []byte(RandStringRunes(4096)))
+	if err != EOVERFLOW {
+		t.Fatalf("expected EOVERFLOW got %v", err)
+	}
+}
+
+func TestCompressionCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+	file, err := os.OpenFile(fn, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	data := []byte(strings.Repeat("hello world ", 100))
+	n, err := WriteAtWriter64Compressed(file, 0, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n >= 16+len(data) {
+		t.Fatalf("expected compressed record, got %d bytes", n)
+	}
+
+	read, err := ReadFromReader64(file, 0, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatal("mismatch")
+	}
+
+	for i := 16; i < n; i++ {
+		b := make([]byte, 1)
+		_, err = file.ReadAt(b, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.WriteAt([]byte{b[0] + 1}, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ReadFromReader64(file, 0, 16)
+		if err != EBADSLT {
+			t.Fatalf("expected EBADSLT got %v", err)
+		}
+
+		_, err = file.WriteAt(b, int64(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestUnknownFlags(t *testing.T) {
+	f := defaultFormat()
+	header := make([]byte, 16)
+	for _, flags := range []uint32{1 << 28, flagSkip | flagCompressed, flagDeleted | flagCompressed, flagSkip | flagDeleted} {
+		f.putHeader(header, 10, flags, 0)
+		_, err := f.parseHeader(header)
+		if err != EBADSLT {
+			t.Fatalf("flags %x: expected EBADSLT got %v", flags, err)
+		}
+	}
+	for _, flags := range []uint32{0, flagCompressed, flagSkip, flagDeleted} {
+		f.putHeader(header, 10, flags, 0)
+		_, err := f.parseHeader(header)
+		if err != nil {
+			t.Fatalf("flags %x: %v", flags, err)
+		}
+	}
+}
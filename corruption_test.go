@@ -0,0 +1,241 @@
+package pen
+
+import (
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+)
+
+type region struct {
+	start, end uint32
+}
+
+func TestCorruptionReporting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	offsets := []uint32{}
+	nexts := []uint32{}
+	for i := 0; i < 1000; i++ {
+		off, next, err := fw.Append([]byte(RandStringRunes(i % 300)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+		nexts = append(nexts, next)
+	}
+	expected := []region{}
+	bytes := int64(0)
+	for _, i := range []int{3, 400, 401, 402, 999} {
+		_, err = fw.file.WriteAt([]byte("garbage"), fw.format.position(offsets[i])+3)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, v := range [][2]int{{3, 3}, {400, 402}, {999, 999}} {
+		end := nexts[v[1]]
+		if v[1] < 999 {
+			end = offsets[v[1]+1]
+		}
+		expected = append(expected, region{offsets[v[0]], end})
+		bytes += fw.format.position(end) - fw.format.position(offsets[v[0]])
+	}
+
+	got := []region{}
+	stats := ScanStats{}
+	err = r.ScanWithOptions(0, ScanOptions{Stats: &stats, OnCorruption: func(start, end uint32, err error) {
+		if err != EBADSLT {
+			t.Fatalf("expected EBADSLT got %v", err)
+		}
+		got = append(got, region{start, end})
+	}}, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Fatalf("expected %v got %v", expected, got)
+		}
+	}
+	if stats.Records != 995 || stats.Corrupted != 3 || stats.CorruptedBytes != bytes {
+		t.Fatalf("unexpected stats %+v, expected %d bytes", stats, bytes)
+	}
+
+	// backwards the same regions are found, the last one ends where the file ends
+	backward := ScanStats{}
+	n := 0
+	err = r.ScanBackwardWithOptions(math.MaxUint32, ScanOptions{Stats: &backward, OnCorruption: func(start, end uint32, err error) {
+		n++
+		if start != expected[len(expected)-n].start {
+			t.Fatalf("expected %v got %d", expected[len(expected)-n], start)
+		}
+	}}, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backward.Records != 995 || backward.Corrupted != 3 {
+		t.Fatalf("unexpected stats %+v", backward)
+	}
+
+	for _, workers := range []int{1, 7, 50} {
+		parallel := ScanStats{}
+		err = ParallelScanWithOptions(r, workers, ScanOptions{Stats: &parallel}, func(data []byte, offset, next uint32) error {
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parallel.Records != stats.Records || parallel.CorruptedBytes != stats.CorruptedBytes {
+			t.Fatalf("%d workers: expected %+v got %+v", workers, stats, parallel)
+		}
+	}
+
+	// strict stops at the first one
+	n = 0
+	err = r.ScanWithOptions(0, ScanOptions{Strict: true}, func(data []byte, offset, next uint32) error {
+		n++
+		return nil
+	})
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) || corruption.Offset != offsets[3] || !errors.Is(err, EBADSLT) || n != 3 {
+		t.Fatalf("expected corruption at %d after 3 records, got %v after %d", offsets[3], err, n)
+	}
+	err = ParallelScanWithOptions(r, 7, ScanOptions{Strict: true}, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if !errors.Is(err, EBADSLT) {
+		t.Fatalf("expected EBADSLT got %v", err)
+	}
+	err = r.ScanBackwardWithOptions(math.MaxUint32, ScanOptions{Strict: true}, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if !errors.As(err, &corruption) || corruption.Offset != offsets[999] {
+		t.Fatalf("expected corruption at %d got %v", offsets[999], err)
+	}
+
+	it := r.Iter(0)
+	for it.Next() {
+	}
+	if it.Stats() != stats {
+		t.Fatalf("expected %+v got %+v", stats, it.Stats())
+	}
+}
+
+func TestNoCorruptionAfterSmallerOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	expected := map[uint32]string{}
+	offsets := []uint32{}
+	for i := 0; i < 50; i++ {
+		data := RandStringRunes(1000)
+		off, _, err := fw.Append([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[off] = data
+		offsets = append(offsets, off)
+	}
+	// the last one too, its freed units are at the end of the file
+	for i := 1; i < len(offsets); i += 7 {
+		off := offsets[i]
+		if i == 43 {
+			off = offsets[len(offsets)-1]
+		}
+		data := RandStringRunes(i)
+		switch i % 3 {
+		case 0:
+			err = fw.Overwrite(off, []byte(data))
+		case 1:
+			var hash uint32
+			_, hash, err = fw.ReadWithHash(off)
+			if err == nil {
+				err = fw.CompareAndOverwrite(off, hash, []byte(data))
+			}
+		case 2:
+			err = fw.SafeOverwrite(off, []byte(data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[off] = data
+	}
+
+	stats := ScanStats{}
+	n := 0
+	err = r.ScanWithOptions(0, ScanOptions{Strict: true, Stats: &stats}, func(data []byte, offset, next uint32) error {
+		if string(data) != expected[offset] {
+			t.Fatalf("mismatch at %d", offset)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(expected) || stats.Corrupted != 0 {
+		t.Fatalf("expected %d records and no corruption, got %d %+v", len(expected), n, stats)
+	}
+
+	n = 0
+	err = r.ScanBackwardWithOptions(math.MaxUint32, ScanOptions{Strict: true}, func(data []byte, offset, next uint32) error {
+		if string(data) != expected[offset] {
+			t.Fatalf("mismatch at %d", offset)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(expected) {
+		t.Fatalf("expected %d got %d", len(expected), n)
+	}
+
+	err = ParallelScanWithOptions(r, 7, ScanOptions{Strict: true}, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,180 @@
+package pen
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// returned when the record checksum is fine, but it can not be decrypted (wrong key or tampered with)
+var EKEYREJECTED = errors.New("record can not be decrypted")
+
+// returned when the record is encrypted with key id that is not in the Keyring
+var ENOKEY = errors.New("encryption key not available")
+
+// 4 bytes LE key id + 12 bytes nonce
+const sealHeaderSize = 4 + 12
+
+// Keyring holds the AES-GCM keys used to encrypt records
+// new records are encrypted with the current key, and old records can be decrypted with any key that was added.
+// Add() is not safe to be used concurrently with Seal/Open, so add all your keys before using it.
+type Keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// Creates new Keyring with current key, key must be 16, 24 or 32 bytes for AES-128, AES-192 or AES-256
+func NewKeyring(keyID uint32, key []byte) (*Keyring, error) {
+	k := &Keyring{current: keyID, aeads: map[uint32]cipher.AEAD{}}
+	err := k.Add(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Add key that can be used to decrypt old records
+func (k *Keyring) Add(keyID uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.aeads[keyID] = aead
+	return nil
+}
+
+// Encrypts the data with the current key
+// format is:
+//
+//	4 bytes LE key id
+//	12 bytes nonce
+//	XX AES-GCM ciphertext and tag, the key id is authenticated as well
+func (k *Keyring) Seal(plain []byte) ([]byte, error) {
+	aead := k.aeads[k.current]
+	sealed := make([]byte, sealHeaderSize, sealHeaderSize+len(plain)+aead.Overhead())
+	binary.LittleEndian.PutUint32(sealed, k.current)
+	_, err := io.ReadFull(rand.Reader, sealed[4:sealHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed[4:sealHeaderSize], plain, sealed[:4]), nil
+}
+
+// Decrypts data created with Seal, returns ENOKEY if the key is unknown and EKEYREJECTED if the data can not be authenticated
+func (k *Keyring) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < sealHeaderSize {
+		return nil, EKEYREJECTED
+	}
+	aead, ok := k.aeads[binary.LittleEndian.Uint32(sealed)]
+	if !ok {
+		return nil, ENOKEY
+	}
+	plain, err := aead.Open(nil, sealed[4:sealHeaderSize], sealed[sealHeaderSize:], sealed[:4])
+	if err != nil {
+		return nil, EKEYREJECTED
+	}
+	return plain, nil
+}
+
+// Writer that encrypts every record before appending it
+// The pen checksum is of the ciphertext, so corruption is still EBADSLT and is caught before decrypting.
+// Compression is not applied to encrypted records, ciphertext does not compress.
+type EncryptedWriter struct {
+	writer *Writer
+	keys   *Keyring
+}
+
+func NewEncryptedWriter(w *Writer, keys *Keyring) *EncryptedWriter {
+	return &EncryptedWriter{writer: w, keys: keys}
+}
+
+// Encrypt and append, returns the same as Writer.Append
+func (ew *EncryptedWriter) Append(plain []byte) (uint32, uint32, error) {
+	sealed, err := ew.keys.Seal(plain)
+	if err != nil {
+		return 0, 0, err
+	}
+	return ew.writer.appendStored(sealed, 0)
+}
+
+// Encrypt and overwrite, same rules as Writer.Overwrite
+func (ew *EncryptedWriter) Overwrite(offset uint32, plain []byte) error {
+	sealed, err := ew.keys.Seal(plain)
+	if err != nil {
+		return err
+	}
+	return ew.writer.overwriteStored(offset, sealed, 0, nil)
+}
+
+func (ew *EncryptedWriter) Sync() error {
+	return ew.writer.Sync()
+}
+
+func (ew *EncryptedWriter) Close() error {
+	return ew.writer.Close()
+}
+
+// Reader that decrypts records written by EncryptedWriter
+type EncryptedReader struct {
+	reader *Reader
+	keys   *Keyring
+}
+
+func NewEncryptedReader(r *Reader, keys *Keyring) *EncryptedReader {
+	return &EncryptedReader{reader: r, keys: keys}
+}
+
+// Read and decrypt, returns the data, next readable offset and error
+func (er *EncryptedReader) Read(offset uint32) ([]byte, uint32, error) {
+	sealed, next, err := er.reader.Read(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	plain, err := er.keys.Open(sealed)
+	if err != nil {
+		return nil, 0, err
+	}
+	return plain, next, nil
+}
+
+// Scan and decrypt, damaged records are skipped exactly like ScanFromReader does, because their checksum fails.
+// A record with valid checksum that can not be decrypted stops the scan with EKEYREJECTED or ENOKEY
+func (er *EncryptedReader) Scan(offset uint32, cb func([]byte, uint32, uint32) error) error {
+	return er.reader.Scan(offset, func(sealed []byte, offset, next uint32) error {
+		plain, err := er.keys.Open(sealed)
+		if err != nil {
+			return err
+		}
+		return cb(plain, offset, next)
+	})
+}
+
+func (er *EncryptedReader) Close() error {
+	return er.reader.Close()
+}
+
+// Encrypt and write at specific offset, same as WriteAtWriter64. Returns how many bytes were written (header included)
+func WriteAtWriter64Encrypted(file io.WriterAt, offset uint64, keys *Keyring, plain []byte) (int, error) {
+	sealed, err := keys.Seal(plain)
+	if err != nil {
+		return 0, err
+	}
+	f := defaultFormat()
+	return f.writeAt(file, offset, sealed, 0)
+}
+
+// Read and decrypt record written with WriteAtWriter64Encrypted
+func ReadFromReader64Encrypted(reader io.ReaderAt, offset uint64, blockSize int, keys *Keyring) ([]byte, error) {
+	sealed, err := ReadFromReader64(reader, offset, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	return keys.Open(sealed)
+}
@@ -0,0 +1,177 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	oldKeys, err := NewKeyring(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewKeyring(2, bytes.Repeat([]byte{2}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = keys.Add(1, bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldWriter := NewEncryptedWriter(fw, oldKeys)
+	w := NewEncryptedWriter(fw, keys)
+	reader := NewEncryptedReader(r, keys)
+	defer reader.Close()
+	defer w.Close()
+
+	cases := []Case{}
+	for i := 0; i < 100; i++ {
+		data := []byte(RandStringRunes(i))
+		ew := w
+		if i%2 == 0 {
+			ew = oldWriter
+		}
+		off, next, err := ew.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+
+		raw, _, err := r.Read(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// short data can show up in the ciphertext by chance
+		if len(data) >= 8 && bytes.Contains(raw, data) {
+			t.Fatal("data is not encrypted")
+		}
+	}
+
+	for _, v := range cases {
+		data, next, err := reader.Read(v.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != v.next {
+			t.Fatalf("expected %d got %d", v.next, next)
+		}
+		if !bytes.Equal(v.data, data) {
+			t.Fatalf("data mismatch, expected %s got %s", v.data, data)
+		}
+	}
+
+	// the old keyring does not know key 2
+	_, _, err = NewEncryptedReader(r, oldKeys).Read(cases[1].document)
+	if err != ENOKEY {
+		t.Fatalf("expected ENOKEY got %v", err)
+	}
+
+	// same key id, different key
+	wrongKeys, err := NewKeyring(2, bytes.Repeat([]byte{3}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = NewEncryptedReader(r, wrongKeys).Read(cases[1].document)
+	if err != EKEYREJECTED {
+		t.Fatalf("expected EKEYREJECTED got %v", err)
+	}
+	err = NewEncryptedReader(r, wrongKeys).Scan(cases[1].document, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if err != EKEYREJECTED {
+		t.Fatalf("expected EKEYREJECTED got %v", err)
+	}
+
+	err = w.Overwrite(cases[10].document, []byte("short"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases[10].data = []byte("short")
+
+	// damage the ciphertext of one record, scan should skip it like any corrupted record
+	_, err = fw.file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(cases[50].document*PAD)+16+4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = reader.Read(cases[50].document)
+	if err != EBADSLT {
+		t.Fatalf("expected EBADSLT got %v", err)
+	}
+
+	n := 0
+	err = reader.Scan(0, func(data []byte, offset, next uint32) error {
+		if n == 50 {
+			n++
+		}
+		if !bytes.Equal(cases[n].data, data) {
+			t.Fatalf("data mismatch, expected %s got %s", cases[n].data, data)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cases) {
+		t.Fatalf("expected %d got %d", len(cases), n)
+	}
+}
+
+func TestEncrypted64(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := os.OpenFile(path.Join(dir, "forward"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	keys, err := NewKeyring(7, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset := uint64(0)
+	offsets := []uint64{}
+	for i := 0; i < 100; i++ {
+		n, err := WriteAtWriter64Encrypted(file, offset, keys, []byte(RandStringRunes(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, offset)
+		offset += uint64(n)
+	}
+
+	for i, off := range offsets {
+		data, err := ReadFromReader64Encrypted(file, off, 16, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != i {
+			t.Fatalf("expected %d got %d", i, len(data))
+		}
+	}
+}
@@ -15,11 +15,16 @@ const FixedHeaderSize = 8
 //   ...
 //   fixed size data
 func FixedWriteAt(file *os.File, index uint64, encoded []byte) error {
+	return FixedWriteAtWithHasher(file, index, encoded, MetroHasher)
+}
+
+// Same as FixedWriteAt but with different checksum algorithm, read it with FixedReadAtWithHasher
+func FixedWriteAtWithHasher(file *os.File, index uint64, encoded []byte, hasher Hasher) error {
 	blobSize := FixedHeaderSize + len(encoded)
 	blob := make([]byte, blobSize)
 	copy(blob[FixedHeaderSize:], encoded)
 
-	binary.LittleEndian.PutUint64(blob, Hash(encoded))
+	binary.LittleEndian.PutUint64(blob, hasher.Sum64(encoded))
 	_, err := file.WriteAt(blob, int64(index*uint64(blobSize)))
 	if err != nil {
 		return err
@@ -39,6 +44,11 @@ func FixedLen(file *os.File, fixedSize uint64) (uint64, error) {
 
 // Read from specific index
 func FixedReadAt(file *os.File, index uint64, into []byte) error {
+	return FixedReadAtWithHasher(file, index, into, MetroHasher)
+}
+
+// Same as FixedReadAt but with different checksum algorithm
+func FixedReadAtWithHasher(file *os.File, index uint64, into []byte, hasher Hasher) error {
 	blockSize := len(into) + FixedHeaderSize
 	block := make([]byte, blockSize)
 	_, err := file.ReadAt(block, int64(index*uint64(blockSize)))
@@ -46,7 +56,7 @@ func FixedReadAt(file *os.File, index uint64, into []byte) error {
 		return err
 	}
 
-	computedChecksumHeader := Hash(block[FixedHeaderSize:])
+	computedChecksumHeader := hasher.Sum64(block[FixedHeaderSize:])
 	checksumHeader := binary.LittleEndian.Uint64(block)
 	if checksumHeader != computedChecksumHeader {
 		return EBADSLT
@@ -0,0 +1,164 @@
+package pen
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Options for FollowWithOptions
+type FollowOptions struct {
+	// How often the file is checked for new data, 0 means 100ms.
+	// On linux inotify wakes Follow up as soon as the file is written, then this is only a fallback.
+	PollInterval time.Duration
+
+	// How long a broken record at the tail is retried before it is treated as corruption and skipped, 0 means 5s.
+	// Appends reserve their space before writing, so the last record can be half written, or still zeroes
+	// while appends after it are already written.
+	Grace time.Duration
+
+	// Called for every deleted record, see ScanOptions
+	OnDeleted func(offset, next uint32) error
+
+	// Called for every corrupted region that was skipped after the grace period, see ScanOptions
+	OnCorruption func(start, end uint32, err error)
+}
+
+// Follow is Scan that does not stop at the end of the file, it waits for new records until ctx is done
+// (and then returns ctx.Err()), or until cb returns error. Example:
+//
+//	err := r.Follow(ctx, checkpoint, func(data []byte, offset, next uint32) error {
+//		process(data)
+//		checkpoint = next
+//		return nil
+//	})
+//
+// A broken record at the end is retried, since it is probably still being written, see FollowOptions.Grace
+func (ar *Reader) Follow(ctx context.Context, offset uint32, cb func([]byte, uint32, uint32) error) error {
+	return ar.FollowWithOptions(ctx, offset, FollowOptions{}, cb)
+}
+
+// Same as Follow, with options
+func (ar *Reader) FollowWithOptions(ctx context.Context, offset uint32, opts FollowOptions, cb func([]byte, uint32, uint32) error) error {
+	if opts.PollInterval == 0 {
+		opts.PollInterval = 100 * time.Millisecond
+	}
+	if opts.Grace == 0 {
+		opts.Grace = 5 * time.Second
+	}
+	f := &ar.format
+	if offset < f.start {
+		offset = f.start
+	}
+
+	w := newWatcher(ar.file.Name())
+	defer w.close()
+
+	var brokenSince time.Time
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fr, next, err := f.frameAt(ar.file, offset, ar.blockSize)
+		if err == nil {
+			brokenSince = time.Time{}
+			switch {
+			case fr.flags&flagSkip != 0:
+			case fr.flags&flagDeleted != 0:
+				if opts.OnDeleted != nil {
+					err = opts.OnDeleted(offset, next)
+				}
+			default:
+				var data []byte
+				data, err = decompress(fr.data, fr.flags)
+				if err == nil {
+					err = cb(data, offset, next)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			offset = next
+			continue
+		}
+
+		wait := opts.PollInterval
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			// nothing new yet, or the last record is not complete
+			brokenSince = time.Time{}
+		case EBADSLT:
+			if brokenSince.IsZero() {
+				brokenSince = time.Now()
+			}
+			left := opts.Grace - time.Since(brokenSince)
+			if left <= 0 {
+				found, ok, err := f.nextFrame(ar.file, offset+1, ar.blockSize)
+				if err != nil {
+					return err
+				}
+				if ok {
+					// it is really corrupted, there is a valid record after it
+					if opts.OnCorruption != nil {
+						opts.OnCorruption(offset, found, EBADSLT)
+					}
+					brokenSince = time.Time{}
+					offset = found
+					continue
+				}
+				left = opts.PollInterval
+			}
+			if left < wait {
+				wait = left
+			}
+		default:
+			return err
+		}
+
+		w.wait(ctx, wait)
+	}
+}
+
+// finds the first valid frame at or after offset, false if there is none until the end of the file
+func (f *format) nextFrame(reader io.ReaderAt, offset uint32, blockSize int) (uint32, bool, error) {
+	var buf []byte
+	for {
+		var err error
+		offset, buf, err = f.resync(reader, offset, 0, buf)
+		if err != nil {
+			return 0, false, err
+		}
+		_, _, err = f.frameAt(reader, offset, blockSize)
+		if err == nil {
+			return offset, true, nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, false, nil
+		}
+		if err != EBADSLT {
+			return 0, false, err
+		}
+		offset++
+	}
+}
+
+type watcher interface {
+	// returns when the file changed, after timeout, or when ctx is done
+	wait(ctx context.Context, timeout time.Duration)
+	close()
+}
+
+// waits for changes by polling
+type pollWatcher struct{}
+
+func (pollWatcher) wait(ctx context.Context, timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+func (pollWatcher) close() {}
@@ -0,0 +1,60 @@
+package pen
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// wakes up on inotify events for the file
+type inotifyWatcher struct {
+	file    *os.File
+	changed chan struct{}
+}
+
+// inotify, or polling if it is not available (e.g. out of watches)
+func newWatcher(filename string) watcher {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return pollWatcher{}
+	}
+	_, err = syscall.InotifyAddWatch(fd, filename, syscall.IN_MODIFY|syscall.IN_ATTRIB)
+	if err != nil {
+		syscall.Close(fd)
+		return pollWatcher{}
+	}
+
+	// non blocking fd goes to the runtime poller, so close interrupts the Read
+	w := &inotifyWatcher{file: os.NewFile(uintptr(fd), "inotify"), changed: make(chan struct{}, 1)}
+	go w.run()
+	return w
+}
+
+func (w *inotifyWatcher) run() {
+	events := make([]byte, 4096)
+	for {
+		_, err := w.file.Read(events)
+		if err != nil {
+			return
+		}
+		select {
+		case w.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *inotifyWatcher) wait(ctx context.Context, timeout time.Duration) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	case <-w.changed:
+	}
+}
+
+func (w *inotifyWatcher) close() {
+	w.file.Close()
+}
@@ -0,0 +1,61 @@
+package pen
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFollowInotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	w := newWatcher(fn)
+	w.close()
+	if _, ok := w.(*inotifyWatcher); !ok {
+		t.Skip("inotify is not available")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan uint32, 10)
+	go r.FollowWithOptions(ctx, 0, FollowOptions{PollInterval: time.Hour}, func(data []byte, offset, next uint32) error {
+		got <- offset
+		return nil
+	})
+
+	// polling once an hour, so only inotify can wake it up
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		off, _, err := fw.Append([]byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case v := <-got:
+			if v != off {
+				t.Fatalf("expected %d got %d", off, v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("not woken up")
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package pen
+
+func newWatcher(filename string) watcher {
+	return pollWatcher{}
+}
@@ -0,0 +1,135 @@
+package pen
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan Case, 100)
+	corrupted := make(chan uint32, 10)
+	done := make(chan error)
+	go func() {
+		opts := FollowOptions{PollInterval: 10 * time.Millisecond, Grace: 200 * time.Millisecond, OnCorruption: func(start, end uint32, err error) {
+			corrupted <- start
+		}}
+		done <- r.FollowWithOptions(ctx, 0, opts, func(data []byte, offset, next uint32) error {
+			got <- Case{document: offset, next: next, data: data}
+			return nil
+		})
+	}()
+
+	expect := func(off uint32, data []byte) {
+		select {
+		case v := <-got:
+			if v.document != off || !bytes.Equal(v.data, data) {
+				t.Fatalf("expected %d got %d", off, v.document)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %d", off)
+		}
+	}
+	nothing := func() {
+		select {
+		case v := <-got:
+			t.Fatalf("unexpected %d", v.document)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		data := []byte(RandStringRunes(i * 10))
+		off, _, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect(off, data)
+	}
+
+	// reserved but not written yet, the records after it have to wait
+	hole, err := fw.reserve(fw.format.units(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _, err := fw.Append([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nothing()
+	_, err = fw.format.writeAt(fw.file, uint64(fw.format.position(hole)), []byte("hello"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(hole, []byte("hello"))
+	expect(after, []byte("after"))
+
+	// never written, so after the grace period it is skipped
+	hole, err = fw.reserve(fw.format.units(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _, err = fw.Append([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nothing()
+	expect(after, []byte("after"))
+	if start := <-corrupted; start != hole {
+		t.Fatalf("expected corruption at %d got %d", hole, start)
+	}
+
+	// half written record at the end
+	data := []byte(RandStringRunes(1000))
+	blob := make([]byte, 16+len(data))
+	fw.format.putFrame(blob, data, 0)
+	tail, err := fw.reserve(fw.format.units(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.file.WriteAt(blob[:500], fw.format.position(tail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	nothing()
+	_, err = fw.file.WriteAt(blob[500:], fw.format.position(tail)+500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(tail, data)
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Follow did not return")
+	}
+}
@@ -2,4 +2,7 @@ module github.com/rekki/go-pen
 
 go 1.13
 
-require github.com/dgryski/go-metro v0.0.0-20180109044635-280f6062b5bc
+require (
+	github.com/cespare/xxhash/v2 v2.1.2
+	github.com/dgryski/go-metro v0.0.0-20180109044635-280f6062b5bc
+)
@@ -0,0 +1,115 @@
+package pen
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// shares one fsync between many concurrent AppendSync calls
+// callers queue a reply channel and one goroutine fsyncs on behalf of everybody waiting
+type groupCommit struct {
+	file     *os.File
+	window   time.Duration
+	maxBatch int
+	requests chan chan error
+
+	// closing the requests channel while someone is sending on it panics, so senders hold
+	// the read lock and close() holds the write lock
+	sync.RWMutex
+	closed bool
+	done   chan struct{}
+
+	// called with the size of every batch before its fsync, for the tests
+	onBatch func(int)
+}
+
+func newGroupCommit(file *os.File, window time.Duration, maxBatch int) *groupCommit {
+	if maxBatch <= 0 {
+		maxBatch = 256
+	}
+	g := &groupCommit{
+		file:     file,
+		window:   window,
+		maxBatch: maxBatch,
+		requests: make(chan chan error, maxBatch),
+		done:     make(chan struct{}),
+	}
+	go g.run()
+	return g
+}
+
+// blocks until fsync that was started after the call returns
+func (g *groupCommit) sync() error {
+	reply := make(chan error, 1)
+
+	g.RLock()
+	if g.closed {
+		g.RUnlock()
+		return os.ErrClosed
+	}
+	g.requests <- reply
+	g.RUnlock()
+
+	return <-reply
+}
+
+func (g *groupCommit) close() {
+	g.Lock()
+	if !g.closed {
+		g.closed = true
+		close(g.requests)
+	}
+	g.Unlock()
+	<-g.done
+}
+
+func (g *groupCommit) run() {
+	defer close(g.done)
+	waiting := make([]chan error, 0, g.maxBatch)
+	for first := range g.requests {
+		waiting = append(waiting[:0], first)
+		waiting = g.collect(waiting)
+
+		if g.onBatch != nil {
+			g.onBatch(len(waiting))
+		}
+		err := g.file.Sync()
+		for _, reply := range waiting {
+			reply <- err
+		}
+	}
+}
+
+// gathers more waiting callers, for up to window time or until maxBatch
+func (g *groupCommit) collect(waiting []chan error) []chan error {
+	if g.window <= 0 {
+		for len(waiting) < g.maxBatch {
+			select {
+			case reply, ok := <-g.requests:
+				if !ok {
+					return waiting
+				}
+				waiting = append(waiting, reply)
+			default:
+				return waiting
+			}
+		}
+		return waiting
+	}
+
+	timer := time.NewTimer(g.window)
+	defer timer.Stop()
+	for len(waiting) < g.maxBatch {
+		select {
+		case reply, ok := <-g.requests:
+			if !ok {
+				return waiting
+			}
+			waiting = append(waiting, reply)
+		case <-timer.C:
+			return waiting
+		}
+	}
+	return waiting
+}
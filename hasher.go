@@ -0,0 +1,225 @@
+package pen
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"math/bits"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-metro"
+)
+
+// Hasher is the checksum algorithm used for records and Fixed* blocks.
+// Records store the low 32 bits of Sum64, Fixed* blocks store all 64 bits.
+type Hasher interface {
+	// Stored in the superblock, so the file knows how it was written.
+	// The built in ones are 0 (metro), 1 (crc32c) and 2 (xxhash), use something else for your own.
+	ID() uint32
+	Sum64(b []byte) uint64
+}
+
+// Hashers that can also checksum incrementally, so records do not have to be kept in memory
+// (see Writer.AppendFrom and Reader.Open). All the built in ones implement it.
+type StreamHasher interface {
+	Hasher
+	// New returns hash.Hash64 whose Sum64 is the same as Hasher.Sum64 of everything written to it
+	New() hash.Hash64
+}
+
+// go-metro, the default
+var MetroHasher Hasher = metroHasher{}
+
+// CRC-32 with the Castagnoli polynomial, hardware accelerated on most platforms and easy to verify from other languages
+var CRC32CHasher Hasher = crc32cHasher{}
+
+// xxHash64 (github.com/cespare/xxhash)
+var XXHasher Hasher = xxHasher{}
+
+type metroHasher struct{}
+
+func (metroHasher) ID() uint32 {
+	return 0
+}
+
+func (metroHasher) Sum64(b []byte) uint64 {
+	return metro.Hash64(b, 0)
+}
+
+func (metroHasher) New() hash.Hash64 {
+	m := &metroDigest{}
+	m.Reset()
+	return m
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type crc32cHasher struct{}
+
+func (crc32cHasher) ID() uint32 {
+	return 1
+}
+
+func (crc32cHasher) Sum64(b []byte) uint64 {
+	return uint64(crc32.Checksum(b, castagnoli))
+}
+
+func (crc32cHasher) New() hash.Hash64 {
+	return crc32Digest{crc32.New(castagnoli)}
+}
+
+type crc32Digest struct {
+	hash.Hash32
+}
+
+func (d crc32Digest) Sum64() uint64 {
+	return uint64(d.Sum32())
+}
+
+type xxHasher struct{}
+
+func (xxHasher) ID() uint32 {
+	return 2
+}
+
+func (xxHasher) Sum64(b []byte) uint64 {
+	return xxhash.Sum64(b)
+}
+
+func (xxHasher) New() hash.Hash64 {
+	return xxhash.New()
+}
+
+// finds the hasher for the id stored in the superblock, custom is used if its id matches
+func hasherByID(id uint32, custom Hasher) (Hasher, error) {
+	if custom != nil && custom.ID() == id {
+		return custom, nil
+	}
+	for _, h := range []Hasher{MetroHasher, CRC32CHasher, XXHasher} {
+		if h.ID() == id {
+			return h, nil
+		}
+	}
+	return nil, ENOTSUP
+}
+
+const (
+	metroK0 = 0xD6D018F5
+	metroK1 = 0xA2AA033B
+	metroK2 = 0x62992FC1
+	metroK3 = 0x30BC5B29
+)
+
+// incremental version of go-metro Hash64 with seed 0, it processes the same 32 byte blocks and the same tail
+type metroDigest struct {
+	hash   uint64
+	v      [4]uint64
+	blocks bool
+	buf    [32]byte
+	n      int
+}
+
+func (m *metroDigest) Reset() {
+	m.hash = metroK2 * metroK0
+	m.v = [4]uint64{m.hash, m.hash, m.hash, m.hash}
+	m.blocks = false
+	m.n = 0
+}
+
+func (m *metroDigest) Size() int {
+	return 8
+}
+
+func (m *metroDigest) BlockSize() int {
+	return 32
+}
+
+func (m *metroDigest) Write(b []byte) (int, error) {
+	written := len(b)
+	if m.n > 0 {
+		c := copy(m.buf[m.n:], b)
+		m.n += c
+		b = b[c:]
+		if m.n < 32 {
+			return written, nil
+		}
+		m.block(m.buf[:])
+		m.n = 0
+	}
+	for len(b) >= 32 {
+		m.block(b[:32])
+		b = b[32:]
+	}
+	m.n = copy(m.buf[:], b)
+	return written, nil
+}
+
+func (m *metroDigest) block(b []byte) {
+	m.blocks = true
+	v := &m.v
+	v[0] += binary.LittleEndian.Uint64(b[:8]) * metroK0
+	v[0] = bits.RotateLeft64(v[0], -29) + v[2]
+	v[1] += binary.LittleEndian.Uint64(b[8:16]) * metroK1
+	v[1] = bits.RotateLeft64(v[1], -29) + v[3]
+	v[2] += binary.LittleEndian.Uint64(b[16:24]) * metroK2
+	v[2] = bits.RotateLeft64(v[2], -29) + v[0]
+	v[3] += binary.LittleEndian.Uint64(b[24:32]) * metroK3
+	v[3] = bits.RotateLeft64(v[3], -29) + v[1]
+}
+
+func (m *metroDigest) Sum(b []byte) []byte {
+	s := m.Sum64()
+	return append(b, byte(s>>56), byte(s>>48), byte(s>>40), byte(s>>32), byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+func (m *metroDigest) Sum64() uint64 {
+	hash := m.hash
+	if m.blocks {
+		v := m.v
+		v[2] ^= bits.RotateLeft64(((v[0]+v[3])*metroK0)+v[1], -37) * metroK1
+		v[3] ^= bits.RotateLeft64(((v[1]+v[2])*metroK1)+v[0], -37) * metroK0
+		v[0] ^= bits.RotateLeft64(((v[0]+v[2])*metroK0)+v[3], -37) * metroK1
+		v[1] ^= bits.RotateLeft64(((v[1]+v[3])*metroK1)+v[2], -37) * metroK0
+		hash += v[0] ^ v[1]
+	}
+
+	ptr := m.buf[:m.n]
+	if len(ptr) >= 16 {
+		v0 := hash + (binary.LittleEndian.Uint64(ptr[:8]) * metroK2)
+		v0 = bits.RotateLeft64(v0, -29) * metroK3
+		v1 := hash + (binary.LittleEndian.Uint64(ptr[8:16]) * metroK2)
+		v1 = bits.RotateLeft64(v1, -29) * metroK3
+		v0 ^= bits.RotateLeft64(v0*metroK0, -21) + v1
+		v1 ^= bits.RotateLeft64(v1*metroK3, -21) + v0
+		hash += v1
+		ptr = ptr[16:]
+	}
+
+	if len(ptr) >= 8 {
+		hash += binary.LittleEndian.Uint64(ptr[:8]) * metroK3
+		ptr = ptr[8:]
+		hash ^= bits.RotateLeft64(hash, -55) * metroK1
+	}
+
+	if len(ptr) >= 4 {
+		hash += uint64(binary.LittleEndian.Uint32(ptr[:4])) * metroK3
+		hash ^= bits.RotateLeft64(hash, -26) * metroK1
+		ptr = ptr[4:]
+	}
+
+	if len(ptr) >= 2 {
+		hash += uint64(binary.LittleEndian.Uint16(ptr[:2])) * metroK3
+		ptr = ptr[2:]
+		hash ^= bits.RotateLeft64(hash, -48) * metroK1
+	}
+
+	if len(ptr) >= 1 {
+		hash += uint64(ptr[0]) * metroK3
+		hash ^= bits.RotateLeft64(hash, -37) * metroK1
+	}
+
+	hash ^= bits.RotateLeft64(hash, -28)
+	hash *= metroK0
+	hash ^= bits.RotateLeft64(hash, -29)
+	return hash
+}
@@ -0,0 +1,197 @@
+package pen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type customHasher struct{}
+
+func (customHasher) ID() uint32 {
+	return 1000
+}
+
+func (customHasher) Sum64(b []byte) uint64 {
+	return MetroHasher.Sum64(b) + 1
+}
+
+func TestHashers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, hasher := range []Hasher{MetroHasher, CRC32CHasher, XXHasher, customHasher{}} {
+		for _, superblock := range []bool{true, false} {
+			fn := path.Join(dir, RandStringRunes(10))
+			fw, err := NewWriterWithOptions(fn, WriterOptions{Superblock: superblock, Hasher: hasher})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cases := []Case{}
+			for i := 0; i < 100; i++ {
+				data := []byte(RandStringRunes(i))
+				off, _, err := fw.Append(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cases = append(cases, Case{document: off, data: data})
+			}
+			fw.Close()
+
+			opts := ReaderOptions{}
+			if !superblock || hasher.ID() == 1000 {
+				opts.Hasher = hasher
+			}
+			reader, err := NewReaderWithOptions(fn, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range cases {
+				data, _, err := reader.Read(v.document)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(v.data, data) {
+					t.Fatalf("data mismatch, expected %s got %s", v.data, data)
+				}
+			}
+			reader.Close()
+
+			if hasher.ID() == 1000 && superblock {
+				_, err = NewReader(fn, 0)
+				if err != ENOTSUP {
+					t.Fatalf("expected ENOTSUP got %v", err)
+				}
+			}
+
+			if hasher != MetroHasher && !superblock {
+				reader, err = NewReader(fn, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _, err = reader.Read(cases[10].document)
+				if err != EBADSLT {
+					t.Fatalf("expected EBADSLT got %v", err)
+				}
+				reader.Close()
+			}
+		}
+	}
+}
+
+func TestCRC32CIsPlainCRC32C(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Hasher: CRC32CHasher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	_, _, err = fw.Append([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := crc32.MakeTable(crc32.Castagnoli)
+	if binary.LittleEndian.Uint32(b[4:]) != crc32.Checksum([]byte("hello world"), table) {
+		t.Fatal("data checksum mismatch")
+	}
+	if binary.LittleEndian.Uint32(b[12:]) != crc32.Checksum(b[:12], table) {
+		t.Fatal("header checksum mismatch")
+	}
+}
+
+func TestFixedAndMonotonicHasher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file, err := os.OpenFile(path.Join(dir, "fixed"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = FixedWriteAtWithHasher(file, 3, []byte("hello"), XXHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	into := make([]byte, 5)
+	err = FixedReadAtWithHasher(file, 3, into, XXHasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(into) != "hello" {
+		t.Fatalf("expected hello got %s", into)
+	}
+	err = FixedReadAt(file, 3, into)
+	if err != EBADSLT {
+		t.Fatalf("expected EBADSLT got %v", err)
+	}
+
+	m, err := NewMonotonicWithOptions(path.Join(dir, "m"), MonotonicOptions{Hasher: CRC32CHasher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		m.MustAppend([]byte(RandStringRunes(i)))
+	}
+	if len(m.MustRead(50)) != 50 {
+		t.Fatal("expected 50")
+	}
+	err = m.TruncateAt(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.MustLast()) != 9 {
+		t.Fatal("expected 9")
+	}
+	m.Close()
+
+	m, err = NewMonotonic(path.Join(dir, "m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	_, err = m.Read(5)
+	if err != EBADSLT {
+		t.Fatalf("expected EBADSLT got %v", err)
+	}
+}
+
+func TestStreamHashers(t *testing.T) {
+	for _, hasher := range []Hasher{MetroHasher, CRC32CHasher, XXHasher} {
+		for i := 0; i < 300; i++ {
+			data := []byte(RandStringRunes(i))
+			h := hasher.(StreamHasher).New()
+			// write in uneven pieces
+			for j := 0; j < len(data); j += j%7 + 1 {
+				end := j + j%7 + 1
+				if end > len(data) {
+					end = len(data)
+				}
+				h.Write(data[j:end])
+			}
+			if h.Sum64() != hasher.Sum64(data) {
+				t.Fatalf("%T: length %d expected %d got %d", hasher, i, hasher.Sum64(data), h.Sum64())
+			}
+		}
+	}
+}
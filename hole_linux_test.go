@@ -0,0 +1,79 @@
+package pen
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestFillHoleOnFailedAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	_, _, err = fw.Append([]byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writes past 4096 bytes fail with EFBIG, so the header of the hole fits but the data does not
+	var limit syscall.Rlimit
+	err = syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signal.Ignore(syscall.SIGXFSZ)
+	defer signal.Reset(syscall.SIGXFSZ)
+	err = syscall.Setrlimit(syscall.RLIMIT_FSIZE, &syscall.Rlimit{Cur: 4096, Max: limit.Max})
+	if err != nil {
+		t.Skip(err)
+	}
+	hole := fw.offset
+	_, _, err = fw.Append(make([]byte, 8192))
+	syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	after, _, err := fw.Append([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after <= hole {
+		t.Fatalf("expected %d > %d", after, hole)
+	}
+
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	counting := &countingReaderAt{r: r.file}
+	offsets := []uint32{}
+	err = ScanFromReader(counting, 0, 16, func(data []byte, offset, next uint32) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 2 || offsets[1] != after {
+		t.Fatalf("unexpected offsets %v", offsets)
+	}
+	// before and after take 2 reads each (header and data), skip record and EOF 1
+	if counting.reads != 6 {
+		t.Fatalf("expected 6 reads got %d", counting.reads)
+	}
+}
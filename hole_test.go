@@ -0,0 +1,86 @@
+package pen
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+)
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int64
+}
+
+func (c *countingReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.r.ReadAt(b, off)
+}
+
+func TestFillHole(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fill := range []bool{false, true} {
+		fn := path.Join(dir, RandStringRunes(10))
+		fw, err := NewWriter(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = fw.Append([]byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// reserved, but the write failed
+		hole, err := fw.reserve(1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, _, err := fw.Append([]byte("after"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fill {
+			fw.fillHole(hole, 1000)
+		}
+
+		r, err := NewReader(fn, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = r.Read(hole)
+		if err != EBADSLT {
+			t.Fatalf("expected EBADSLT got %v", err)
+		}
+
+		counting := &countingReaderAt{r: r.file}
+		offsets := []uint32{}
+		err = ScanFromReader(counting, 0, 16, func(data []byte, offset, next uint32) error {
+			offsets = append(offsets, offset)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(offsets) != 2 || offsets[1] != after {
+			t.Fatalf("unexpected offsets %v", offsets)
+		}
+		// before and after take 2 reads each (header and data), skip record and EOF 1
+		if fill && counting.reads != 6 {
+			t.Fatalf("expected 6 reads got %d", counting.reads)
+		}
+		// without the skip record the hole is corruption, one more read to find the header after it
+		if !fill && counting.reads != 7 {
+			t.Fatalf("expected 7 reads got %d", counting.reads)
+		}
+
+		r.Close()
+		fw.Close()
+	}
+}
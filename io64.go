@@ -12,7 +12,7 @@ import (
 //   XX variable length data
 //
 //   header:
-//      4 bytes LE len(data) [1] // LE = Little Endian
+//      4 bytes LE len(data) [1] // LE = Little Endian, top 4 bits are flags (e.g. compressed)
 //      4 bytes LE HASH(data)[2] // go-metro
 //      4 bytes MAGIC        [3] // 0xbeef
 //      4 bytes LE HASH(1 2 3)   // hash of the first 12 bytes
@@ -20,62 +20,142 @@ import (
 //      ..
 //      ..
 func WriteAtWriter64(file io.WriterAt, offset uint64, encoded []byte) error {
-	blobSize := 16 + len(encoded)
+	f := defaultFormat()
+	_, err := f.writeAt(file, offset, encoded, 0)
+	return err
+}
+
+// Same as WriteAtWriter64 but compresses the data with flate if that makes it smaller.
+// ReadFromReader64 decompresses transparently. Returns how many bytes were written (header included)
+func WriteAtWriter64Compressed(file io.WriterAt, offset uint64, encoded []byte) (int, error) {
+	stored, flags := compress(Deflate, encoded)
+	f := defaultFormat()
+	return f.writeAt(file, offset, stored, flags)
+}
+
+func (f *format) writeAt(file io.WriterAt, offset uint64, stored []byte, flags uint32) (int, error) {
+	if len(stored) > maxRecordSize {
+		return 0, EMSGSIZE
+	}
+	blobSize := 16 + len(stored)
 	blob := make([]byte, blobSize)
-	copy(blob[16:], encoded)
-	binary.LittleEndian.PutUint32(blob[0:], uint32(len(encoded)))
-	binary.LittleEndian.PutUint32(blob[4:], uint32(Hash(encoded)))
-	copy(blob[8:], MAGIC)
-	binary.LittleEndian.PutUint32(blob[12:], uint32(Hash(blob[:12])))
+	f.putFrame(blob, stored, flags)
 
 	_, err := file.WriteAt(blob, int64(offset))
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return blobSize, nil
 }
 
 func ReadFromReader64(reader io.ReaderAt, offset uint64, blockSize int) ([]byte, error) {
-	block := make([]byte, blockSize)
+	f := defaultFormat()
+	fr, err := f.readFrame(reader, offset, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	if fr.flags&flagSkip != 0 {
+		return nil, EBADSLT
+	}
+	if fr.flags&flagDeleted != 0 {
+		return nil, ErrDeleted
+	}
+	return decompress(fr.data, fr.flags)
+}
+
+// one verified record
+type frame struct {
+	// the stored bytes (still compressed), nil for skip records
+	data  []byte
+	flags uint32
+	// len(data), or for skip records how many pad units to jump
+	length uint32
+	// checksum of data from the header
+	hash uint32
+}
+
+// reads and verifies the record at offset
+func (f *format) readFrame(reader io.ReaderAt, offset uint64, blockSize int) (frame, error) {
+	fr, _, err := f.readFrameInto(reader, offset, blockSize, nil)
+	return fr, err
+}
+
+// same as readFrame, but reads into buf (grown if it is too small), the data of the frame points into it.
+// returns the buffer so it can be reused for the next read
+func (f *format) readFrameInto(reader io.ReaderAt, offset uint64, blockSize int, buf []byte) (frame, []byte, error) {
+	if cap(buf) < blockSize {
+		buf = make([]byte, blockSize)
+	}
+	block := buf[:blockSize]
 	n, err := reader.ReadAt(block, int64(offset))
 
 	// end of file, or not enough space to read whole block_size
 	if n < 16 {
-		return nil, err
-	}
-	if n != blockSize {
-		block = block[:n]
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, buf, err
 	}
+	block = block[:n]
 
 	header := block[:16]
-	if !bytes.Equal(header[8:12], MAGIC) {
-		return nil, EBADSLT
+	fr, err := f.parseHeader(header)
+	if err != nil {
+		return frame{}, buf, err
 	}
-
-	computedChecksumHeader := uint32(Hash(header[:12]))
-	checksumHeader := binary.LittleEndian.Uint32(header[12:16])
-	if checksumHeader != computedChecksumHeader {
-		return nil, EBADSLT
+	if fr.flags&flagSkip != 0 {
+		return fr, buf, nil
 	}
-
-	metadataLen := binary.LittleEndian.Uint32(header)
+	metadataLen := int(fr.length)
 
 	var readInto []byte
-	if int(metadataLen) < len(block)-len(header) {
-		readInto = block[len(header) : len(header)+int(metadataLen)]
+	if metadataLen <= len(block)-len(header) {
+		readInto = block[len(header) : len(header)+metadataLen]
 	} else {
-		readInto = make([]byte, metadataLen)
+		if cap(buf) < len(header)+metadataLen {
+			buf = make([]byte, len(header)+metadataLen)
+		}
+		readInto = buf[len(header) : len(header)+metadataLen]
 		_, err = reader.ReadAt(readInto, int64(offset)+int64(len(header)))
 		if err != nil {
-			return nil, err
+			return frame{}, buf, err
 		}
 	}
 
-	checksumHeaderData := binary.LittleEndian.Uint32(header[4:])
-	computedChecksumData := uint32(Hash(readInto))
+	computedChecksumData := uint32(f.hasher.Sum64(readInto))
 
-	if checksumHeaderData != computedChecksumData {
-		return nil, EBADSLT
+	if fr.hash != computedChecksumData {
+		return frame{}, buf, EBADSLT
+	}
+	fr.data = readInto
+	return fr, buf, nil
+}
+
+// verifies the 16 byte header, the data is not read
+func (f *format) parseHeader(header []byte) (frame, error) {
+	if !bytes.Equal(header[8:12], f.magic) {
+		return frame{}, EBADSLT
+	}
+
+	computedChecksumHeader := uint32(f.hasher.Sum64(header[:12]))
+	checksumHeader := binary.LittleEndian.Uint32(header[12:16])
+	if checksumHeader != computedChecksumHeader {
+		return frame{}, EBADSLT
+	}
+
+	fr := frame{
+		length: binary.LittleEndian.Uint32(header) & maxRecordSize,
+		flags:  binary.LittleEndian.Uint32(header) &^ maxRecordSize,
+		hash:   binary.LittleEndian.Uint32(header[4:]),
+	}
+	if fr.flags&flagSkip != 0 && fr.length == 0 {
+		return frame{}, EBADSLT
+	}
+	// at most one flag is set, anything else (e.g. the unused bit 28) is not a header written by this version
+	switch fr.flags {
+	case 0, flagCompressed, flagSkip, flagDeleted:
+	default:
+		return frame{}, EBADSLT
 	}
-	return readInto, nil
+	return fr, nil
 }
@@ -0,0 +1,224 @@
+package pen
+
+import "io"
+
+// Iterator is the pull style Scan, it makes it easy to merge or zip several logs, or to stop early:
+//
+//	it := r.Iter(0)
+//	defer it.Close()
+//	for it.Next() {
+//		log.Printf("%d: %s", it.Offset(), it.Data())
+//	}
+//	if err := it.Err(); err != nil {
+//		panic(err)
+//	}
+//
+// It returns the same records as Scan (which is built on it), corrupted regions and deleted records are skipped.
+// It is not safe to use concurrently, but many iterators can be used on the same Reader
+type Iterator struct {
+	frames frameIterator
+	data   []byte
+	// decompressed data with ScanOptions.ReuseBuffer
+	out []byte
+	err error
+}
+
+// Iter returns iterator starting from offset
+func (ar *Reader) Iter(offset uint32) *Iterator {
+	return ar.format.iter(ar.file, offset, ar.blockSize, ScanOptions{})
+}
+
+// Same as Iter, with options. ScanOptions.OnDeleted returning error stops the iteration with that error
+func (ar *Reader) IterWithOptions(offset uint32, opts ScanOptions) *Iterator {
+	return ar.format.iter(ar.file, offset, ar.blockSize, opts)
+}
+
+// Iterator over ReaderAt, the pull style ScanFromReader
+func IterFromReader(reader io.ReaderAt, offset uint32, blockSize int) *Iterator {
+	f := defaultFormat()
+	return f.iter(reader, offset, blockSize, ScanOptions{})
+}
+
+func (f *format) iter(reader io.ReaderAt, offset uint32, blockSize int, opts ScanOptions) *Iterator {
+	return &Iterator{frames: f.iterFrames(reader, offset, blockSize, opts)}
+}
+
+// Next moves to the next record, returns false at the end of the file or on error (check Err)
+func (it *Iterator) Next() bool {
+	if it.err != nil || !it.frames.next() {
+		it.data = nil
+		return false
+	}
+
+	fr := it.frames.frame
+	var err error
+	if it.frames.opts.ReuseBuffer && fr.flags&flagCompressed != 0 {
+		it.out, err = decompressInto(it.out, fr.data, fr.flags)
+		it.data = it.out
+	} else {
+		it.data, err = decompress(fr.data, fr.flags)
+	}
+	if err != nil {
+		it.err = err
+		it.data = nil
+		return false
+	}
+	return true
+}
+
+// Data of the current record, with ScanOptions.ReuseBuffer it is only valid until the next call to Next
+func (it *Iterator) Data() []byte {
+	return it.data
+}
+
+// Offset of the current record
+func (it *Iterator) Offset() uint32 {
+	return it.frames.offset
+}
+
+// Offset after the current record, you can continue from there later
+func (it *Iterator) NextOffset() uint32 {
+	return it.frames.nextOffset
+}
+
+// Err returns the error that stopped the iteration, reaching the end of the file is not an error
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.frames.err
+}
+
+// Stats so far, see ScanStats
+func (it *Iterator) Stats() ScanStats {
+	return it.frames.stats
+}
+
+// Close stops the iteration and releases the buffers, it does not close the Reader
+func (it *Iterator) Close() error {
+	it.frames.done = true
+	it.frames.buf = nil
+	it.frames.resyncBuf = nil
+	it.data = nil
+	it.out = nil
+	return nil
+}
+
+// walks the live frames, jumps over skip records and resyncs after corruption
+type frameIterator struct {
+	format    *format
+	reader    io.ReaderAt
+	blockSize int
+	opts      ScanOptions
+	buf       []byte
+	resyncBuf []byte
+
+	// where the next frame is looked for
+	position uint32
+
+	// the current frame
+	frame      frame
+	offset     uint32
+	nextOffset uint32
+
+	err  error
+	done bool
+
+	// start of the corrupted region being skipped
+	corrupted    bool
+	corruptStart uint32
+	stats        ScanStats
+
+	// where the first record (or the end) was found
+	started bool
+	first   uint32
+}
+
+func (f *format) iterFrames(reader io.ReaderAt, offset uint32, blockSize int, opts ScanOptions) frameIterator {
+	if offset < f.start {
+		offset = f.start
+	}
+	if opts.ReadAhead > 0 {
+		reader = newReadAhead(reader, opts.ReadAhead, opts.Prefetch)
+	}
+	return frameIterator{format: f, reader: reader, blockSize: blockSize, opts: opts, position: offset}
+}
+
+func (it *frameIterator) next() bool {
+	for !it.done {
+		offset := it.position
+		if it.opts.end != 0 && offset >= it.opts.end {
+			it.endCorruption(offset)
+			break
+		}
+		fr, next, grown, err := it.format.frameAtInto(it.reader, offset, it.blockSize, it.buf)
+		if it.opts.ReuseBuffer {
+			it.buf = grown
+		}
+		if err == EBADSLT {
+			if it.opts.Strict && !(it.opts.partition && !it.started) {
+				it.err = &CorruptionError{Offset: offset}
+				break
+			}
+			// assume corrupted file, so just skip until we find next valid entry
+			if !it.corrupted && !(it.opts.partition && !it.started) {
+				it.corrupted = true
+				it.corruptStart = offset
+			}
+			it.position, it.resyncBuf, err = it.format.resync(it.reader, offset+1, it.opts.end, it.resyncBuf)
+			if err != nil {
+				it.err = err
+				break
+			}
+			continue
+		}
+		it.endCorruption(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			it.err = err
+			break
+		}
+		it.position = next
+		if fr.flags&flagSkip != 0 {
+			continue
+		}
+		if fr.flags&flagDeleted != 0 {
+			it.stats.Deleted++
+			if it.opts.OnDeleted != nil {
+				err = it.opts.OnDeleted(offset, next)
+				if err != nil {
+					it.err = err
+					break
+				}
+			}
+			continue
+		}
+		it.stats.Records++
+		it.frame = fr
+		it.offset = offset
+		it.nextOffset = next
+		return true
+	}
+	it.done = true
+	it.frame = frame{}
+	return false
+}
+
+// called when a record or the end is found at end, reports the corrupted region being skipped, if any
+func (it *frameIterator) endCorruption(end uint32) {
+	if !it.started {
+		it.started = true
+		it.first = end
+	}
+	if !it.corrupted {
+		return
+	}
+	it.corrupted = false
+	it.stats.Corrupted++
+	it.stats.CorruptedBytes += it.format.position(end) - it.format.position(it.corruptStart)
+	if it.opts.OnCorruption != nil {
+		it.opts.OnCorruption(it.corruptStart, end, EBADSLT)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build go1.23
+// +build go1.23
+
+package pen
+
+import "iter"
+
+// All adapts the iterator to range over func, it yields the offset and the data of each record:
+//
+//	it := r.Iter(0)
+//	defer it.Close()
+//	for offset, data := range it.All() {
+//		log.Printf("%d: %s", offset, data)
+//	}
+//	if err := it.Err(); err != nil {
+//		panic(err)
+//	}
+func (it *Iterator) All() iter.Seq2[uint32, []byte] {
+	return func(yield func(uint32, []byte) bool) {
+		for it.Next() {
+			if !yield(it.Offset(), it.Data()) {
+				return
+			}
+		}
+	}
+}
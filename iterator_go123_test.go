@@ -0,0 +1,63 @@
+//go:build go1.23
+// +build go1.23
+
+package pen
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIteratorAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	offsets := []uint32{}
+	for i := 0; i < 10; i++ {
+		off, _, err := fw.Append([]byte(RandStringRunes(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+	}
+
+	it := r.Iter(0)
+	defer it.Close()
+	i := 0
+	for offset, data := range it.All() {
+		if offset != offsets[i] || len(data) != i {
+			t.Fatalf("mismatch at %d", offset)
+		}
+		i++
+		if i == 5 {
+			break
+		}
+	}
+	// breaking out does not lose the iterator position
+	for offset := range it.All() {
+		if offset != offsets[i] {
+			t.Fatalf("expected %d got %d", offsets[i], offset)
+		}
+		i++
+	}
+	if it.Err() != nil || i != 10 {
+		t.Fatalf("expected 10 records, got %d %v", i, it.Err())
+	}
+}
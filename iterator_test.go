@@ -0,0 +1,104 @@
+package pen
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Compression: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	offsets := []uint32{}
+	for i := 0; i < 300; i++ {
+		off, _, err := fw.Append([]byte(RandStringRunes(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+	}
+	err = fw.Delete(offsets[100])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.file.WriteAt([]byte("garbage"), fw.format.position(offsets[200])+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Case{}
+	err = r.Scan(0, func(data []byte, offset, next uint32) error {
+		expected = append(expected, Case{document: offset, next: next, data: data})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, it := range []*Iterator{r.Iter(0), r.IterWithOptions(0, ScanOptions{ReuseBuffer: true, ReadAhead: 1024}), IterFromReader(r.file, 0, 16)} {
+		i := 0
+		for it.Next() {
+			v := expected[i]
+			if it.Offset() != v.document || it.NextOffset() != v.next || !bytes.Equal(it.Data(), v.data) {
+				t.Fatalf("mismatch at %d", it.Offset())
+			}
+			i++
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if i != len(expected) {
+			t.Fatalf("expected %d got %d", len(expected), i)
+		}
+		if it.Next() {
+			t.Fatal("expected no more records")
+		}
+		it.Close()
+	}
+
+	// continue from the next offset of the half
+	half := r.Iter(0)
+	for i := 0; i < 150; i++ {
+		half.Next()
+	}
+	half.Close()
+	if half.Next() {
+		t.Fatal("expected no records after Close")
+	}
+	it := r.Iter(expected[149].next)
+	if !it.Next() || it.Offset() != expected[150].document {
+		t.Fatalf("expected %d", expected[150].document)
+	}
+	it.Close()
+
+	stop := errors.New("stop")
+	it = r.IterWithOptions(0, ScanOptions{OnDeleted: func(offset, next uint32) error {
+		return stop
+	}})
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if it.Err() != stop || n != 100 {
+		t.Fatalf("expected stop after 100, got %v after %d", it.Err(), n)
+	}
+}
@@ -0,0 +1,119 @@
+package pen
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// SafeOverwrite is crash safe version of Overwrite: after a crash either the old or the new version survives.
+// The new version is first written to a journal next to the file (filename + ".journal") and synced,
+// then the record is overwritten in place and synced. If the in place write was torn, the next
+// NewWriter on the file finds the record broken and replays it from the journal.
+// It is slower than Overwrite, it does two fsyncs, and it returns only after the data is on disk.
+func (fw *Writer) SafeOverwrite(offset uint32, encoded []byte) error {
+	stored, flags := compress(fw.compression, encoded)
+
+	lock := fw.lock(offset)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old, err := fw.liveFrame(offset)
+	if err != nil {
+		return err
+	}
+	if len(old.data) < len(stored) {
+		return EOVERFLOW
+	}
+
+	blob := fw.format.overwriteBlob(stored, flags, len(old.data))
+
+	fw.journalLock.Lock()
+	defer fw.journalLock.Unlock()
+
+	err = fw.writeJournal(fw.format.position(offset), blob)
+	if err != nil {
+		return err
+	}
+
+	_, err = fw.file.WriteAt(blob, fw.format.position(offset))
+	invalidateCaches(fw.info, offset)
+	if err != nil {
+		return err
+	}
+	err = fw.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	// no need to sync, replay only happens if the record is broken
+	return fw.journal.Truncate(0)
+}
+
+func journalName(fd *os.File) string {
+	return fd.Name() + ".journal"
+}
+
+// journal is one record in the file's format:
+//
+//	8 bytes LE position in the file
+//	XX the header and data to write there
+func (fw *Writer) writeJournal(position int64, blob []byte) error {
+	if fw.journal == nil {
+		journal, err := os.OpenFile(journalName(fw.file), os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		fw.journal = journal
+	}
+
+	entry := make([]byte, 8+len(blob))
+	binary.LittleEndian.PutUint64(entry, uint64(position))
+	copy(entry[8:], blob)
+
+	err := fw.journal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = fw.format.writeAt(fw.journal, 0, entry, 0)
+	if err != nil {
+		return err
+	}
+	return fw.journal.Sync()
+}
+
+// replays the journal left by SafeOverwrite that did not finish, if the record it was writing is broken
+func (f *format) replayJournal(fd *os.File) error {
+	journal, err := os.OpenFile(journalName(fd), os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	fr, err := f.readFrame(journal, 0, 4096)
+	if err == nil && len(fr.data) > 8+16 && fr.flags == 0 {
+		position := int64(binary.LittleEndian.Uint64(fr.data))
+		blob := fr.data[8:]
+
+		_, err = f.readFrame(fd, uint64(position), 16)
+		if err != nil {
+			_, err = fd.WriteAt(blob, position)
+			if err != nil {
+				return err
+			}
+			err = fd.Sync()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// torn journal means the in place write never started, the old version is intact
+
+	err = journal.Truncate(0)
+	if err != nil {
+		return err
+	}
+	return journal.Sync()
+}
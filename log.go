@@ -0,0 +1,284 @@
+package pen
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Position of a record in a Log, segment number in the high 32 bits and the offset within the segment in the low 32 bits
+type Position uint64
+
+func NewPosition(segment, offset uint32) Position {
+	return Position(uint64(segment)<<32 | uint64(offset))
+}
+
+func (p Position) Segment() uint32 {
+	return uint32(p >> 32)
+}
+
+func (p Position) Offset() uint32 {
+	return uint32(p)
+}
+
+// Options for OpenLog
+type LogOptions struct {
+	// Roll over to a new segment once the current one reaches this size in bytes, 0 means 1GB
+	SegmentSize int64
+
+	// blockSize for the segment readers, see NewReader
+	BlockSize int
+
+	// Options for the segment writers
+	Writer WriterOptions
+}
+
+type segment struct {
+	id     uint32
+	writer *Writer
+	reader *Reader
+}
+
+// Log is a directory of numbered pen files (segments), so it is not limited by the 32 bit offset of a single file.
+// Only the last segment is written to, it rolls over to a new segment when it reaches LogOptions.SegmentSize
+// (or when the Writer returns EFBIG).
+// The Log is *safe* to be used concurrently.
+// example usage:
+//
+//	l, err := OpenLog(dir, LogOptions{SegmentSize: 1 << 30})
+//	if err != nil {
+//		panic(err)
+//	}
+//	pos, err := l.Append([]byte("hello world"))
+//	if err != nil {
+//		panic(err)
+//	}
+//	data, _, err := l.Read(pos)
+//	if err != nil {
+//		panic(err)
+//	}
+//	log.Printf("%s", string(data))
+type Log struct {
+	dir  string
+	opts LogOptions
+
+	sync.RWMutex
+	segments []*segment
+}
+
+// Opens (or creates) the log in dir, segments are named 0000000000.pen, 0000000001.pen and so on
+func OpenLog(dir string, opts LogOptions) (*Log, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 1 << 30
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []uint32{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".pen") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), ".pen"), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) == 0 {
+		ids = append(ids, 0)
+	}
+
+	l := &Log{dir: dir, opts: opts}
+	for i, id := range ids {
+		s, err := l.openSegment(id, i == len(ids)-1)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		l.segments = append(l.segments, s)
+	}
+	return l, nil
+}
+
+func (l *Log) segmentPath(id uint32) string {
+	return path.Join(l.dir, fmt.Sprintf("%010d.pen", id))
+}
+
+func (l *Log) openSegment(id uint32, writable bool) (*segment, error) {
+	s := &segment{id: id}
+	if writable {
+		w, err := NewWriterWithOptions(l.segmentPath(id), l.opts.Writer)
+		if err != nil {
+			return nil, err
+		}
+		s.writer = w
+	}
+
+	r, err := NewReaderWithOptions(l.segmentPath(id), ReaderOptions{BlockSize: l.opts.BlockSize, Hasher: l.opts.Writer.Hasher})
+	if err != nil {
+		if s.writer != nil {
+			s.writer.Close()
+		}
+		return nil, err
+	}
+	s.reader = r
+	return s, nil
+}
+
+// Append to the last segment, returns the position of the record
+func (l *Log) Append(encoded []byte) (Position, error) {
+	for {
+		l.RLock()
+		active := l.segments[len(l.segments)-1]
+		off, next, err := active.writer.Append(encoded)
+		size := active.writer.format.position(next)
+		l.RUnlock()
+
+		if err == EFBIG {
+			err = l.roll(active)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if size >= l.opts.SegmentSize {
+			err = l.roll(active)
+			if err != nil {
+				return 0, err
+			}
+		}
+		return NewPosition(active.id, off), nil
+	}
+}
+
+// starts new segment after active, unless someone else already did
+func (l *Log) roll(active *segment) error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.segments[len(l.segments)-1] != active {
+		return nil
+	}
+	if active.id == math.MaxUint32 {
+		return EFBIG
+	}
+
+	s, err := l.openSegment(active.id+1, true)
+	if err != nil {
+		return err
+	}
+
+	err = active.writer.Sync()
+	if err != nil {
+		s.writer.Close()
+		s.reader.Close()
+		return err
+	}
+	err = active.writer.Close()
+	active.writer = nil
+	l.segments = append(l.segments, s)
+	return err
+}
+
+func (l *Log) segment(id uint32) *segment {
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].id >= id })
+	if i < len(l.segments) && l.segments[i].id == id {
+		return l.segments[i]
+	}
+	return nil
+}
+
+// returns the first segment with id >= the given one
+func (l *Log) segmentFrom(id uint32) *segment {
+	l.RLock()
+	defer l.RUnlock()
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].id >= id })
+	if i < len(l.segments) {
+		return l.segments[i]
+	}
+	return nil
+}
+
+// Read record at position, returns the data, next position in the same segment and error
+func (l *Log) Read(pos Position) ([]byte, Position, error) {
+	l.RLock()
+	s := l.segment(pos.Segment())
+	l.RUnlock()
+	if s == nil {
+		return nil, 0, os.ErrNotExist
+	}
+
+	data, next, err := s.reader.Read(pos.Offset())
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, NewPosition(s.id, next), nil
+}
+
+// Scan all segments starting at position, crossing segment boundaries.
+// If the callback returns error this error is returned as the Scan error
+func (l *Log) Scan(from Position, cb func([]byte, Position, Position) error) error {
+	id := from.Segment()
+	offset := from.Offset()
+	for {
+		s := l.segmentFrom(id)
+		if s == nil {
+			return nil
+		}
+		if s.id != id {
+			offset = 0
+		}
+
+		err := s.reader.Scan(offset, func(data []byte, offset, next uint32) error {
+			return cb(data, NewPosition(s.id, offset), NewPosition(s.id, next))
+		})
+		if err != nil {
+			return err
+		}
+		if s.id == ^uint32(0) {
+			return nil
+		}
+		id = s.id + 1
+		offset = 0
+	}
+}
+
+// Sync the active segment, the rolled over ones are synced when rolling
+func (l *Log) Sync() error {
+	l.RLock()
+	defer l.RUnlock()
+	return l.segments[len(l.segments)-1].writer.Sync()
+}
+
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	var err error
+	for _, s := range l.segments {
+		if s.writer != nil {
+			if e := s.writer.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+		if e := s.reader.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenLog(dir, LogOptions{SegmentSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type logCase struct {
+		pos  Position
+		data []byte
+	}
+	cases := []logCase{}
+	for i := 0; i < 300; i++ {
+		data := []byte(RandStringRunes(i))
+		pos, err := l.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, logCase{pos: pos, data: data})
+	}
+
+	if cases[len(cases)-1].pos.Segment() < 2 {
+		t.Fatalf("expected more segments, got %d", cases[len(cases)-1].pos.Segment())
+	}
+
+	check := func(l *Log, cases []logCase) {
+		for _, v := range cases {
+			data, _, err := l.Read(v.pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(v.data, data) {
+				t.Fatalf("data mismatch, expected %s got %s", v.data, data)
+			}
+		}
+
+		n := 0
+		err = l.Scan(0, func(data []byte, pos, next Position) error {
+			if pos != cases[n].pos {
+				t.Fatalf("expected %d got %d", cases[n].pos, pos)
+			}
+			if !bytes.Equal(cases[n].data, data) {
+				t.Fatalf("data mismatch, expected %s got %s", cases[n].data, data)
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(cases) {
+			t.Fatalf("expected %d got %d", len(cases), n)
+		}
+
+		from := 150
+		n = from
+		err = l.Scan(cases[from].pos, func(data []byte, pos, next Position) error {
+			if pos != cases[n].pos {
+				t.Fatalf("expected %d got %d", cases[n].pos, pos)
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(cases) {
+			t.Fatalf("expected %d got %d", len(cases), n)
+		}
+	}
+	check(l, cases)
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenLog(dir, LogOptions{SegmentSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	check(l, cases)
+
+	pos, err := l.Append([]byte("after reopen"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos <= cases[len(cases)-1].pos {
+		t.Fatalf("expected position after %d got %d", cases[len(cases)-1].pos, pos)
+	}
+	cases = append(cases, logCase{pos: pos, data: []byte("after reopen")})
+	check(l, cases)
+
+	_, _, err = l.Read(NewPosition(1000, 0))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected not exist, got %v", err)
+	}
+}
+
+func TestLogConcurrentRoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenLog(dir, LogOptions{SegmentSize: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	positions := make([][]Position, 16)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				pos, err := l.Append([]byte(RandStringRunes(i % 32)))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				positions[g] = append(positions[g], pos)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	seen := map[Position]bool{}
+	for _, p := range positions {
+		for _, pos := range p {
+			if seen[pos] {
+				t.Fatalf("position %d returned twice", pos)
+			}
+			seen[pos] = true
+			_, _, err := l.Read(pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	n := 0
+	err = l.Scan(0, func(data []byte, pos, next Position) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(seen) {
+		t.Fatalf("expected %d got %d", len(seen), n)
+	}
+}
+
+func TestLogRefusesToWrapSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := OpenLog(dir, LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	active := l.segments[len(l.segments)-1]
+	active.id = math.MaxUint32
+	if err := l.roll(active); err != EFBIG {
+		t.Fatalf("expected EFBIG got %v", err)
+	}
+}
+
+func TestWriterRefusesToWrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fw, err := NewWriter(path.Join(dir, "forward"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	fw.offset = math.MaxUint32
+	_, _, err = fw.Append([]byte("hello world"))
+	if err != EFBIG {
+		t.Fatalf("expected EFBIG got %v", err)
+	}
+	_, err = fw.AppendBatch([][]byte{[]byte("hello world")})
+	if err != EFBIG {
+		t.Fatalf("expected EFBIG got %v", err)
+	}
+	if fw.offset != math.MaxUint32 {
+		t.Fatalf("offset moved to %d", fw.offset)
+	}
+}
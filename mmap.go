@@ -0,0 +1,211 @@
+package pen
+
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// the file was truncated under the mapping (e.g. by WriterOptions.Recover)
+var errShrunk = errors.New("mapped file shrunk")
+
+// Reader that maps the file in memory instead of reading it with pread, so Read and Scan do not make syscalls.
+// The records are still verified on every read. When a read goes past the end of the mapping
+// the file is checked and mapped again if it grew, so it can be used while a Writer is appending.
+// Touching a mapped page past the end of a file that was truncated (WriterOptions.Recover truncates the torn tail
+// when a Writer is opened) raises SIGBUS, the reader catches that fault, maps the file again with its new size and
+// reads past the end return io.EOF. Still, prefer opening the MmapReader after the recovering Writer.
+// It has the same methods as Reader (see RecordReader), and is *safe* to use concurrently
+type MmapReader struct {
+	file   *os.File
+	format format
+
+	lock sync.RWMutex
+	data []byte
+}
+
+// Maps the file read only, example:
+//
+//	r, err := NewMmapReader(filename)
+//	if err != nil {
+//		panic(err)
+//	}
+//	data, _, err := r.Read(docID)
+//	if err != nil {
+//		panic(err)
+//	}
+//
+// mmap is supported on linux and the BSDs (including darwin), elsewhere it returns ENOTSUP
+func NewMmapReader(filename string) (*MmapReader, error) {
+	return NewMmapReaderWithOptions(filename, ReaderOptions{})
+}
+
+// Same as NewMmapReader, the BlockSize option is ignored since there are no syscalls to save
+func NewMmapReaderWithOptions(filename string, opts ReaderOptions) (*MmapReader, error) {
+	fd, err := os.OpenFile(filename, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	m := &MmapReader{file: fd}
+	_, err = m.remap()
+	if err == nil {
+		m.format, err = readerFormat(m, opts.Hasher)
+	}
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadAt copies from the mapping, if the read goes past its end and the file grew or shrunk it is mapped again
+func (m *MmapReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := m.readAt(p, off)
+	if err != io.EOF && err != errShrunk {
+		return n, err
+	}
+	if err == errShrunk {
+		n = 0
+	}
+	changed, err := m.remap()
+	if err != nil {
+		return 0, err
+	}
+	if !changed {
+		return n, io.EOF
+	}
+	n, err = m.readAt(p, off)
+	if err == errShrunk {
+		return 0, io.EOF
+	}
+	return n, err
+}
+
+func (m *MmapReader) readAt(p []byte, off int64) (n int, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	// turn SIGBUS from pages past the end of a truncated file into errShrunk
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); !ok {
+				panic(r)
+			}
+			n, err = 0, errShrunk
+		}
+	}()
+
+	if m.file == nil {
+		return 0, os.ErrClosed
+	}
+	if off < 0 {
+		return 0, EINVAL
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// maps the file again if its size is different from the mapping, returns if it did
+func (m *MmapReader) remap() (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.file == nil {
+		return false, os.ErrClosed
+	}
+
+	st, err := m.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := st.Size()
+	if size == int64(len(m.data)) {
+		return false, nil
+	}
+	if int64(int(size)) != size {
+		return false, EFBIG
+	}
+	if size == 0 {
+		munmap(m.data)
+		m.data = nil
+		return true, nil
+	}
+
+	data, err := mmap(m.file, int(size))
+	if err != nil {
+		return false, err
+	}
+	if m.data != nil {
+		munmap(m.data)
+	}
+	m.data = data
+	return true, nil
+}
+
+func (m *MmapReader) Scan(offset uint32, cb func([]byte, uint32, uint32) error) error {
+	return m.format.scan(m, offset, 16, ScanOptions{}, cb)
+}
+
+func (m *MmapReader) ScanWithOptions(offset uint32, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	return m.format.scan(m, offset, 16, opts, cb)
+}
+
+func (m *MmapReader) ScanBackward(from uint32, cb func([]byte, uint32, uint32) error) error {
+	return m.ScanBackwardWithOptions(from, ScanOptions{}, cb)
+}
+
+func (m *MmapReader) ScanBackwardWithOptions(from uint32, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	_, err := m.remap()
+	if err != nil {
+		return err
+	}
+	m.lock.RLock()
+	size := len(m.data)
+	m.lock.RUnlock()
+	return m.format.scanBackward(m, int64(size), from, 16, opts, cb)
+}
+
+func (m *MmapReader) Iter(offset uint32) *Iterator {
+	return m.format.iter(m, offset, 16, ScanOptions{})
+}
+
+func (m *MmapReader) IterWithOptions(offset uint32, opts ScanOptions) *Iterator {
+	return m.format.iter(m, offset, 16, opts)
+}
+
+func (m *MmapReader) Read(offset uint32) ([]byte, uint32, error) {
+	return m.format.read(m, offset, 16)
+}
+
+func (m *MmapReader) ReadInto(offset uint32, dst []byte) ([]byte, uint32, error) {
+	return m.format.readInto(m, offset, 16, dst)
+}
+
+func (m *MmapReader) Open(offset uint32) (io.ReadCloser, error) {
+	return m.format.open(m, offset)
+}
+
+// Unmaps and closes the file, using the reader after Close returns os.ErrClosed
+func (m *MmapReader) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.file == nil {
+		return os.ErrClosed
+	}
+	if m.data != nil {
+		munmap(m.data)
+		m.data = nil
+	}
+	err := m.file.Close()
+	m.file = nil
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package pen
+
+import "os"
+
+func mmap(file *os.File, size int) ([]byte, error) {
+	return nil, ENOTSUP
+}
+
+func munmap(data []byte) {}
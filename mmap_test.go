@@ -0,0 +1,185 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMmapReader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Superblock: true, Hasher: CRC32CHasher})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+
+	mr, err := NewMmapReader(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cases := []Case{}
+	for i := 0; i < 500; i++ {
+		data := []byte(RandStringRunes(i))
+		off, next, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+
+		// the file grows after the mapping, so it has to be remapped
+		if i%100 == 0 {
+			got, rnext, err := mr.Read(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rnext != next || !bytes.Equal(got, data) {
+				t.Fatalf("mismatch at %d", off)
+			}
+		}
+	}
+
+	for _, reader := range []RecordReader{r, mr} {
+		var buf []byte
+		for _, v := range cases {
+			buf, _, err = reader.ReadInto(v.document, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf, v.data) {
+				t.Fatalf("mismatch at %d", v.document)
+			}
+		}
+
+		i := 0
+		err = reader.Scan(0, func(data []byte, offset, next uint32) error {
+			if offset != cases[i].document || next != cases[i].next || !bytes.Equal(data, cases[i].data) {
+				t.Fatalf("mismatch at %d", offset)
+			}
+			i++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != len(cases) {
+			t.Fatalf("expected %d got %d", len(cases), i)
+		}
+	}
+
+	// corruption is still detected
+	_, err = fw.file.WriteAt([]byte{0xff}, fw.format.position(cases[10].document)+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mr.Read(cases[10].document)
+	if err != EBADSLT {
+		t.Fatalf("expected EBADSLT got %v", err)
+	}
+
+	err = mr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mr.Read(cases[0].document)
+	if err != os.ErrClosed {
+		t.Fatalf("expected os.ErrClosed got %v", err)
+	}
+}
+
+func TestMmapReaderTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []Case{}
+	for i := 0; i < 500; i++ {
+		data := []byte(RandStringRunes(100))
+		off, next, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+	}
+	fw.Close()
+
+	mr, err := NewMmapReader(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mr.Close()
+
+	last := cases[len(cases)-1]
+	_, _, err = mr.Read(last.document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the pages past the new end are still mapped, touching them must not crash
+	err = os.Truncate(fn, int64(cases[0].next*PAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = mr.Read(last.document)
+	if err == nil {
+		t.Fatal("expected error reading past the truncated end")
+	}
+	data, _, err := mr.Read(cases[0].document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, cases[0].data) {
+		t.Fatal("mismatch")
+	}
+
+	n := 0
+	err = mr.Scan(0, func(data []byte, offset, next uint32) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 record got %d", n)
+	}
+
+	// and it grows again
+	fw, err = NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	off, _, err := fw.Append([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err = mr.Read(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected hello got %s", data)
+	}
+}
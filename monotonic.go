@@ -14,9 +14,20 @@ type Monotonic struct {
 	dataFD            *os.File
 	current           uint64
 	currentDataOffset uint64
+	format            format
+}
+
+// Options for NewMonotonicWithOptions
+type MonotonicOptions struct {
+	// Checksum algorithm for both the index and the data file, nil means MetroHasher
+	Hasher Hasher
 }
 
 func NewMonotonic(fn string) (*Monotonic, error) {
+	return NewMonotonicWithOptions(fn, MonotonicOptions{})
+}
+
+func NewMonotonicWithOptions(fn string, opts MonotonicOptions) (*Monotonic, error) {
 	dataFD, err := os.OpenFile(fmt.Sprintf("%s.data", fn), os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
@@ -27,11 +38,20 @@ func NewMonotonic(fn string) (*Monotonic, error) {
 		return nil, err
 	}
 
-	return NewMonotonicFromFile(indexFD, dataFD)
-
+	m, err := NewMonotonicFromFileWithOptions(indexFD, dataFD, opts)
+	if err != nil {
+		dataFD.Close()
+		indexFD.Close()
+		return nil, err
+	}
+	return m, nil
 }
 
 func NewMonotonicFromFile(indexFD, dataFD *os.File) (*Monotonic, error) {
+	return NewMonotonicFromFileWithOptions(indexFD, dataFD, MonotonicOptions{})
+}
+
+func NewMonotonicFromFileWithOptions(indexFD, dataFD *os.File, opts MonotonicOptions) (*Monotonic, error) {
 	currentDataOffset, err := dataFD.Seek(0, os.SEEK_END)
 	if err != nil {
 		return nil, err
@@ -42,7 +62,12 @@ func NewMonotonicFromFile(indexFD, dataFD *os.File) (*Monotonic, error) {
 		return nil, err
 	}
 
-	return &Monotonic{indexFD: indexFD, dataFD: dataFD, currentDataOffset: uint64(currentDataOffset), current: current}, nil
+	f := defaultFormat()
+	if opts.Hasher != nil {
+		f.hasher = opts.Hasher
+	}
+
+	return &Monotonic{indexFD: indexFD, dataFD: dataFD, currentDataOffset: uint64(currentDataOffset), current: current, format: f}, nil
 }
 
 func (m *Monotonic) AppendAt(index uint64, b []byte) error {
@@ -56,7 +81,7 @@ func (m *Monotonic) AppendAt(index uint64, b []byte) error {
 		m.current = index
 	}
 
-	err := WriteAtWriter64(m.dataFD, currentDataOffset, b)
+	_, err := m.format.writeAt(m.dataFD, currentDataOffset, b, 0)
 	if err != nil {
 		return err
 	}
@@ -64,7 +89,7 @@ func (m *Monotonic) AppendAt(index uint64, b []byte) error {
 	o := make([]byte, 8)
 	binary.LittleEndian.PutUint64(o, currentDataOffset)
 
-	err = FixedWriteAt(m.indexFD, index, o)
+	err = FixedWriteAtWithHasher(m.indexFD, index, o, m.format.hasher)
 	if err != nil {
 		return err
 	}
@@ -116,15 +141,16 @@ func (m *Monotonic) MustRead(id uint64) []byte {
 // it truncates two files the requested id
 func (m *Monotonic) TruncateAt(id uint64) error {
 	o := make([]byte, 8)
-	err := FixedReadAt(m.indexFD, id, o)
+	err := FixedReadAtWithHasher(m.indexFD, id, o, m.format.hasher)
 	if err != nil {
 		return err
 	}
 	dataOffset := binary.LittleEndian.Uint64(o)
-	data, err := ReadFromReader64(m.dataFD, dataOffset, 16)
+	fr, err := m.format.readFrame(m.dataFD, dataOffset, 16)
 	if err != nil {
 		return err
 	}
+	data := fr.data
 
 	m.current = id
 	m.currentDataOffset = dataOffset + 16 + uint64(len(data))
@@ -145,17 +171,17 @@ func (m *Monotonic) TruncateAt(id uint64) error {
 
 func (m *Monotonic) Read(id uint64) ([]byte, error) {
 	o := make([]byte, 8)
-	err := FixedReadAt(m.indexFD, id, o)
+	err := FixedReadAtWithHasher(m.indexFD, id, o, m.format.hasher)
 	if err != nil {
 		return nil, err
 	}
 	off := binary.LittleEndian.Uint64(o)
-	data, err := ReadFromReader64(m.dataFD, off, 16)
+	fr, err := m.format.readFrame(m.dataFD, off, 16)
 	if err != nil {
 		return nil, err
 	}
 
-	return data, nil
+	return decompress(fr.data, fr.flags)
 }
 
 func (m *Monotonic) Count() uint64 {
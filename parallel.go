@@ -0,0 +1,149 @@
+package pen
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+var errStopped = errors.New("stopped")
+
+// ParallelScan splits the file in workers byte ranges and scans them concurrently, cb is called from all of them at the same time.
+// Each worker resyncs to the first valid record at or after the start of its range (like Scan after corruption),
+// and stops at the first record at or after the start of the next range, so every record is delivered once,
+// by the range its offset is in. The records of one range are delivered in order.
+// The first error returned by cb stops all workers and is returned.
+func ParallelScan(reader *Reader, workers int, cb func([]byte, uint32, uint32) error) error {
+	return ParallelScanWithOptions(reader, workers, ScanOptions{}, cb)
+}
+
+// Same as ParallelScan, with options. OnDeleted and OnCorruption are also called concurrently, ReadAhead and ReuseBuffer are per worker.
+// A corrupted region that crosses the start of a range can be reported in two parts, and Strict stops all workers
+// (but the other workers may have delivered records after the corruption already)
+func ParallelScanWithOptions(reader *Reader, workers int, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	if workers < 1 {
+		return EINVAL
+	}
+	st, err := reader.file.Stat()
+	if err != nil {
+		return err
+	}
+	f := reader.format
+	end := (st.Size() + int64(f.pad) - 1) / int64(f.pad)
+	if end > math.MaxUint32 {
+		end = math.MaxUint32
+	}
+	start := int64(f.start)
+	if end <= start {
+		return nil
+	}
+	span := (end - start + int64(workers) - 1) / int64(workers)
+
+	var stopped int32
+	var firstErr error
+	var once sync.Once
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			atomic.StoreInt32(&stopped, 1)
+		})
+	}
+
+	type partition struct {
+		stats ScanStats
+		// the first valid record, and where the scan stopped
+		first    uint32
+		stop     uint32
+		complete bool
+	}
+	partitions := []*partition{}
+
+	wg := sync.WaitGroup{}
+	for from := start; from < end; from += span {
+		until := from + span
+		if until >= end {
+			// the last one scans to the end of the file, even if it grew
+			until = 0
+		}
+
+		popts := opts
+		popts.end = uint32(until)
+		popts.partition = from != start
+		if opts.OnDeleted != nil {
+			popts.OnDeleted = func(offset, next uint32) error {
+				if atomic.LoadInt32(&stopped) != 0 {
+					return errStopped
+				}
+				return opts.OnDeleted(offset, next)
+			}
+		}
+
+		p := &partition{}
+		partitions = append(partitions, p)
+		wg.Add(1)
+		go func(from uint32, popts ScanOptions) {
+			defer wg.Done()
+			it := f.iter(reader.file, from, reader.blockSize, popts)
+			defer it.Close()
+
+			var err error
+			for it.Next() {
+				if atomic.LoadInt32(&stopped) != 0 {
+					err = errStopped
+					break
+				}
+				err = cb(it.Data(), it.Offset(), it.NextOffset())
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = it.Err()
+			}
+			p.stats = it.Stats()
+			p.first = it.frames.first
+			p.stop = it.frames.position
+			p.complete = err == nil
+			if err != nil && err != errStopped {
+				fail(err)
+			}
+		}(uint32(from), popts)
+	}
+	wg.Wait()
+
+	stats := ScanStats{}
+	// the furthest an earlier partition got, a record can span several partitions
+	covered := uint32(0)
+	for i, p := range partitions {
+		stats.Records += p.stats.Records
+		stats.Deleted += p.stats.Deleted
+		stats.Corrupted += p.stats.Corrupted
+		stats.CorruptedBytes += p.stats.CorruptedBytes
+
+		// the workers skip to their first record quietly, since they can start in the middle of a record.
+		// Only the part that the previous ones did not cover is corrupted
+		gapStart := covered
+		if p.complete && p.stop > covered {
+			covered = p.stop
+		}
+		if i == 0 || !p.complete || !partitions[i-1].complete || gapStart >= p.first {
+			continue
+		}
+		if opts.Strict {
+			if firstErr == nil {
+				firstErr = &CorruptionError{Offset: gapStart}
+			}
+			continue
+		}
+		stats.Corrupted++
+		stats.CorruptedBytes += f.position(p.first) - f.position(gapStart)
+		if opts.OnCorruption != nil {
+			opts.OnCorruption(gapStart, p.first, EBADSLT)
+		}
+	}
+	if opts.Stats != nil {
+		*opts.Stats = stats
+	}
+	return firstErr
+}
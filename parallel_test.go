@@ -0,0 +1,155 @@
+package pen
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+func TestParallelScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Superblock: true, Compression: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	offsets := []uint32{}
+	for i := 0; i < 2000; i++ {
+		off, _, err := fw.Append([]byte(RandStringRunes((i * 31) % 1000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+	}
+	for i := 5; i < len(offsets); i += 50 {
+		err = fw.Delete(offsets[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.file.WriteAt([]byte("garbage"), fw.format.position(offsets[i+1])+3)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[uint32][]byte{}
+	err = r.Scan(0, func(data []byte, offset, next uint32) error {
+		expected[offset] = data
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 3, 8, 100, 100000} {
+		var lock sync.Mutex
+		got := map[uint32][]byte{}
+		deleted := 0
+		opts := ScanOptions{OnDeleted: func(offset, next uint32) error {
+			lock.Lock()
+			defer lock.Unlock()
+			deleted++
+			return nil
+		}}
+		err = ParallelScanWithOptions(r, workers, opts, func(data []byte, offset, next uint32) error {
+			lock.Lock()
+			defer lock.Unlock()
+			if _, ok := got[offset]; ok {
+				t.Errorf("offset %d delivered twice", offset)
+			}
+			got[offset] = data
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(expected) {
+			t.Fatalf("%d workers: expected %d got %d", workers, len(expected), len(got))
+		}
+		for offset, data := range expected {
+			if !bytes.Equal(got[offset], data) {
+				t.Fatalf("%d workers: mismatch at %d", workers, offset)
+			}
+		}
+		if deleted != 40 {
+			t.Fatalf("%d workers: expected 40 deleted got %d", workers, deleted)
+		}
+	}
+
+	stop := errors.New("stop")
+	err = ParallelScan(r, 4, func(data []byte, offset, next uint32) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("expected stop got %v", err)
+	}
+
+	err = ParallelScan(r, 0, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if err != EINVAL {
+		t.Fatalf("expected EINVAL got %v", err)
+	}
+}
+
+func TestParallelScanRecordSpansPartitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// 100 units each, so with 200 workers every record covers several partitions
+	for i := 0; i < 20; i++ {
+		_, _, err := fw.Append([]byte(RandStringRunes(int(100*PAD) - 16)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, strict := range []bool{false, true} {
+		stats := ScanStats{}
+		var mu sync.Mutex
+		n := 0
+		err = ParallelScanWithOptions(r, 200, ScanOptions{Strict: strict, Stats: &stats}, func(data []byte, offset, next uint32) error {
+			mu.Lock()
+			n++
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("strict %v: %v", strict, err)
+		}
+		if n != 20 || stats.Records != 20 || stats.Corrupted != 0 || stats.CorruptedBytes != 0 {
+			t.Fatalf("strict %v: expected 20 records and no corruption, got %d %+v", strict, n, stats)
+		}
+	}
+}
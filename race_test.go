@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package pen
+
+// sync.Pool drops items at random with the race detector, so the allocation counts do not hold
+const raceEnabled = true
@@ -0,0 +1,113 @@
+package pen
+
+import "io"
+
+// ReaderAt for sequential scans, it reads big chunks and serves the small reads of the scan from them.
+// A record that crosses the end of the chunk starts the next chunk, so it takes one read too.
+// With prefetch the next chunk is read in the background while the current one is parsed.
+type readAhead struct {
+	reader   io.ReaderAt
+	size     int
+	prefetch bool
+
+	// the bytes at [start, start+len(window)), and the error after them (e.g. io.EOF at the end of the file)
+	start  int64
+	window []byte
+	err    error
+
+	// the chunk being prefetched, it starts where the window ends
+	pending chan chunk
+}
+
+type chunk struct {
+	data []byte
+	err  error
+}
+
+func newReadAhead(reader io.ReaderAt, size int, prefetch bool) *readAhead {
+	return &readAhead{reader: reader, size: size, prefetch: prefetch}
+}
+
+func (r *readAhead) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) > r.size {
+		// bigger than a chunk, no point in buffering it
+		return r.reader.ReadAt(p, off)
+	}
+	n, ok, err := r.fromWindow(p, off)
+	if ok {
+		return n, err
+	}
+	r.fill(off)
+	n, ok, err = r.fromWindow(p, off)
+	if ok {
+		return n, err
+	}
+	// the window still ends before the read does (e.g. off was near the end of the prefetched chunk)
+	return r.reader.ReadAt(p, off)
+}
+
+// copies from the window, returns false if it does not have the data yet
+func (r *readAhead) fromWindow(p []byte, off int64) (int, bool, error) {
+	end := r.start + int64(len(r.window))
+	if off < r.start || off > end {
+		return 0, false, nil
+	}
+	n := copy(p, r.window[off-r.start:])
+	if n == len(p) {
+		return n, true, nil
+	}
+	if r.err != nil {
+		return n, true, r.err
+	}
+	return 0, false, nil
+}
+
+// moves the window to start at off
+func (r *readAhead) fill(off int64) {
+	if r.pending != nil {
+		next := <-r.pending
+		r.pending = nil
+		end := r.start + int64(len(r.window))
+
+		if off >= r.start && off <= end {
+			// the rest of the window followed by the prefetched chunk
+			tail := r.window[off-r.start:]
+			window := make([]byte, len(tail)+len(next.data))
+			copy(window, tail)
+			copy(window[len(tail):], next.data)
+			r.setWindow(off, window, next.err)
+			return
+		}
+		if off >= end && off <= end+int64(len(next.data)) {
+			r.setWindow(off, next.data[off-end:], next.err)
+			return
+		}
+		// the scan jumped somewhere else, the prefetched chunk is useless
+	}
+
+	window := make([]byte, r.size)
+	n, err := r.reader.ReadAt(window, off)
+	if n == len(window) {
+		err = nil
+	}
+	r.setWindow(off, window[:n], err)
+}
+
+func (r *readAhead) setWindow(start int64, window []byte, err error) {
+	r.start = start
+	r.window = window
+	r.err = err
+	if !r.prefetch || err != nil {
+		return
+	}
+
+	r.pending = make(chan chunk, 1)
+	go func(pending chan chunk, off int64) {
+		data := make([]byte, r.size)
+		n, err := r.reader.ReadAt(data, off)
+		if n == len(data) {
+			err = nil
+		}
+		pending <- chunk{data: data[:n], err: err}
+	}(r.pending, start+int64(len(window)))
+}
@@ -0,0 +1,156 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+)
+
+func TestScanReadAhead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	offsets := []uint32{}
+	for i := 0; i < 1000; i++ {
+		size := i
+		if i%100 == 0 {
+			// bigger than the chunk
+			size = 5000
+		}
+		off, _, err := fw.Append([]byte(RandStringRunes(size)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, off)
+	}
+	err = fw.Delete(offsets[50])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.file.WriteAt([]byte("garbage"), fw.format.position(offsets[200])+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Case{}
+	err = r.Scan(0, func(data []byte, offset, next uint32) error {
+		expected = append(expected, Case{document: offset, next: next, data: data})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, prefetch := range []bool{false, true} {
+		counting := &countingReaderAt{r: r.file}
+		got := []Case{}
+		opts := ScanOptions{ReadAhead: 4096, Prefetch: prefetch}
+		err = ScanFromReaderWithOptions(counting, 0, 16, opts, func(data []byte, offset, next uint32) error {
+			got = append(got, Case{document: offset, next: next, data: data})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(got) != len(expected) {
+			t.Fatalf("expected %d got %d", len(expected), len(got))
+		}
+		for i := range got {
+			if got[i].document != expected[i].document || got[i].next != expected[i].next || !bytes.Equal(got[i].data, expected[i].data) {
+				t.Fatalf("mismatch at %d", got[i].document)
+			}
+		}
+
+		st, err := r.file.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// one read per chunk, plus the records bigger than the chunk, plus a few for the records crossing the chunk boundary
+		reads := atomic.LoadInt64(&counting.reads)
+		if reads > 2*st.Size()/4096+10*2+1 {
+			t.Fatalf("too many reads %d for %d bytes", reads, st.Size())
+		}
+	}
+}
+
+func TestScanReadAheadSmallChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for i := 0; i < 300; i++ {
+		_, _, err := fw.Append([]byte(RandStringRunes(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []Case{}
+	err = r.Scan(0, func(data []byte, offset, next uint32) error {
+		expected = append(expected, Case{document: offset, next: next, data: data})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks smaller than most records, so the reads keep landing near the end of the window
+	for _, size := range []int{17, 32, 64, 100, 128, 500} {
+		for _, prefetch := range []bool{false, true} {
+			got := []Case{}
+			stats := ScanStats{}
+			opts := ScanOptions{ReadAhead: size, Prefetch: prefetch, Stats: &stats}
+			err = r.ScanWithOptions(0, opts, func(data []byte, offset, next uint32) error {
+				got = append(got, Case{document: offset, next: next, data: data})
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Corrupted != 0 {
+				t.Fatalf("size %d prefetch %v: unexpected corruption %+v", size, prefetch, stats)
+			}
+			if len(got) != len(expected) {
+				t.Fatalf("size %d prefetch %v: expected %d got %d", size, prefetch, len(expected), len(got))
+			}
+			for i := range got {
+				if got[i].document != expected[i].document || got[i].next != expected[i].next || !bytes.Equal(got[i].data, expected[i].data) {
+					t.Fatalf("size %d prefetch %v: mismatch at %d", size, prefetch, got[i].document)
+				}
+			}
+		}
+	}
+}
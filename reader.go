@@ -2,6 +2,7 @@ package pen
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 )
@@ -9,9 +10,100 @@ import (
 var EBADSLT = errors.New("checksum mismatch")
 var EINVAL = errors.New("invalid argument")
 
+var errSkip = errors.New("skip record")
+
+// returned when reading a record removed with Writer.Delete
+var ErrDeleted = errors.New("record is deleted")
+
+// Returned by ScanOptions.Strict scans, the records before Offset were scanned fine. errors.Is(err, EBADSLT) is true
+type CorruptionError struct {
+	Offset uint32
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted record at offset %d", e.Offset)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return EBADSLT
+}
+
+// Summary of a scan, see ScanOptions.Stats
+type ScanStats struct {
+	// returned and deleted records
+	Records int
+	Deleted int
+	// corrupted regions that were skipped, and how many bytes they had in total
+	Corrupted      int
+	CorruptedBytes int64
+}
+
+// Options for ScanWithOptions and ScanFromReaderWithOptions
+type ScanOptions struct {
+	// Called for every deleted record instead of silently skipping it, returning error stops the scan
+	OnDeleted func(offset, next uint32) error
+
+	// Reuse one growing buffer for all records instead of allocating for each one.
+	// The data given to the callback is only valid until it returns, copy it if you need it after that.
+	ReuseBuffer bool
+
+	// Read the file in chunks of ReadAhead bytes (e.g. 4<<20) and parse the records from memory,
+	// instead of at least one read per record. 0 means no read ahead.
+	ReadAhead int
+
+	// With ReadAhead, read the next chunk in the background while the current one is scanned
+	Prefetch bool
+
+	// Called for every corrupted region that was skipped, [start, end) in offsets, err says why (usually EBADSLT).
+	// The region is reported when the scan finds the next valid record after it (or the end of the file).
+	OnCorruption func(start, end uint32, err error)
+
+	// Stop at the first corruption with *CorruptionError, instead of skipping to the next valid record
+	Strict bool
+
+	// If set, the scan fills it in when it returns (also when it returns error)
+	Stats *ScanStats
+
+	// stop before the first record at or after end, 0 means the end of the file (used by ParallelScan)
+	end uint32
+	// the scan starts at arbitrary offset (used by ParallelScan), the resync to the first record is not corruption
+	partition bool
+}
+
+// The methods shared by Reader and MmapReader, so they can be swapped
+type RecordReader interface {
+	Read(offset uint32) ([]byte, uint32, error)
+	ReadInto(offset uint32, dst []byte) ([]byte, uint32, error)
+	Scan(offset uint32, cb func([]byte, uint32, uint32) error) error
+	ScanWithOptions(offset uint32, opts ScanOptions, cb func([]byte, uint32, uint32) error) error
+	ScanBackward(from uint32, cb func([]byte, uint32, uint32) error) error
+	ScanBackwardWithOptions(from uint32, opts ScanOptions, cb func([]byte, uint32, uint32) error) error
+	Iter(offset uint32) *Iterator
+	IterWithOptions(offset uint32, opts ScanOptions) *Iterator
+	Open(offset uint32) (io.ReadCloser, error)
+	Close() error
+}
+
 type Reader struct {
 	file      *os.File
 	blockSize int
+	format    format
+	cache     *recordCache
+}
+
+// Options for NewReaderWithOptions
+type ReaderOptions struct {
+	// see NewReader
+	BlockSize int
+
+	// Checksum algorithm for files without superblock, nil means MetroHasher.
+	// For files with superblock the one recorded in the file is used.
+	Hasher Hasher
+
+	// Cache up to CacheBytes of recently read records (Read and ReadInto, Scan bypasses it), 0 means no cache.
+	// The records are verified when they are loaded, and Writers in the same process invalidate the records
+	// they overwrite or delete. Changes made by other processes are not seen until the record is evicted.
+	CacheBytes int
 }
 
 // Create New AppendReader (you just nice wrapper around ReadFromReader adn ScanFromReader)
@@ -36,10 +128,15 @@ type Reader struct {
 // You can reduce that to 1 syscall if your data fits within 1 block, do not set blockSize < 16 because this is the header length.
 // blockSize 0 means 16
 func NewReader(filename string, blockSize int) (*Reader, error) {
-	if blockSize == 0 {
-		blockSize = 16
-	}
-	if blockSize < 16 {
+	return NewReaderWithOptions(filename, ReaderOptions{BlockSize: blockSize})
+}
+
+func NewReaderFromFile(fd *os.File, blockSize int) (*Reader, error) {
+	return NewReaderFromFileWithOptions(fd, ReaderOptions{BlockSize: blockSize})
+}
+
+func NewReaderWithOptions(filename string, opts ReaderOptions) (*Reader, error) {
+	if opts.BlockSize != 0 && opts.BlockSize < 16 {
 		return nil, EINVAL
 	}
 
@@ -47,10 +144,16 @@ func NewReader(filename string, blockSize int) (*Reader, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewReaderFromFile(fd, blockSize)
+	r, err := NewReaderFromFileWithOptions(fd, opts)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return r, nil
 }
 
-func NewReaderFromFile(fd *os.File, blockSize int) (*Reader, error) {
+func NewReaderFromFileWithOptions(fd *os.File, opts ReaderOptions) (*Reader, error) {
+	blockSize := opts.BlockSize
 	if blockSize == 0 {
 		blockSize = 16
 	}
@@ -58,23 +161,110 @@ func NewReaderFromFile(fd *os.File, blockSize int) (*Reader, error) {
 		return nil, EINVAL
 	}
 
-	return &Reader{
+	f, err := readerFormat(fd, opts.Hasher)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{
 		file:      fd,
 		blockSize: blockSize,
-	}, nil
+		format:    f,
+	}
+	if opts.CacheBytes > 0 {
+		info, err := fd.Stat()
+		if err != nil {
+			return nil, err
+		}
+		r.cache = newRecordCache(info, opts.CacheBytes)
+		registerCache(r.cache)
+	}
+	return r, nil
+}
+
+// the settings from the superblock, or the defaults with the given hasher for files without one
+func readerFormat(reader io.ReaderAt, hasher Hasher) (format, error) {
+	f, ok, err := readSuperblock(reader, hasher)
+	if err != nil {
+		return format{}, err
+	}
+	if !ok {
+		f = defaultFormat()
+		if hasher != nil {
+			f.hasher = hasher
+		}
+	}
+	return f, nil
 }
 
 // Scan the open file, if the callback returns error this error is returned as the Scan error. just a wrapper around ScanFromReader.
 func (ar *Reader) Scan(offset uint32, cb func([]byte, uint32, uint32) error) error {
-	return ScanFromReader(ar.file, offset, ar.blockSize, cb)
+	return ar.format.scan(ar.file, offset, ar.blockSize, ScanOptions{}, cb)
+}
+
+// Same as Scan, with options
+func (ar *Reader) ScanWithOptions(offset uint32, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	return ar.format.scan(ar.file, offset, ar.blockSize, opts, cb)
 }
 
 // Read at specific offset (just wrapper around ReadFromReader), returns the data, next readable offset and error
+// Deleted records return ErrDeleted (and the next offset)
 func (ar *Reader) Read(offset uint32) ([]byte, uint32, error) {
-	return ReadFromReader(ar.file, offset, ar.blockSize)
+	if ar.cache != nil {
+		return ar.readCached(offset, nil)
+	}
+	return ar.format.read(ar.file, offset, ar.blockSize)
+}
+
+// Same as Read, but the data is copied into dst (grown if it is too small, check the returned slice) instead of a new buffer,
+// so reading with the same dst over and over does not allocate
+//
+//	var buf []byte
+//	for _, offset := range offsets {
+//		buf, _, err = r.ReadInto(offset, buf)
+//		if err != nil {
+//			panic(err)
+//		}
+//		process(buf)
+//	}
+func (ar *Reader) ReadInto(offset uint32, dst []byte) ([]byte, uint32, error) {
+	if ar.cache != nil {
+		return ar.readCached(offset, dst)
+	}
+	return ar.format.readInto(ar.file, offset, ar.blockSize, dst)
+}
+
+// the cached data is copied into dst, so nobody can modify it
+func (ar *Reader) readCached(offset uint32, dst []byte) ([]byte, uint32, error) {
+	data, next, generation, ok := ar.cache.get(offset)
+	if !ok {
+		var err error
+		data, next, err = ar.format.read(ar.file, offset, ar.blockSize)
+		if err != nil {
+			return nil, next, err
+		}
+		// data points into the block read by format.read, copy it so the cache does not pin the whole block
+		data = append([]byte(nil), data...)
+		ar.cache.put(offset, next, data, generation)
+	}
+	if dst == nil {
+		dst = make([]byte, 0, len(data))
+	}
+	return append(dst[:0], data...), next, nil
+}
+
+// Hits and misses of the cache (see ReaderOptions.CacheBytes), zero if there is no cache
+func (ar *Reader) CacheStats() CacheStats {
+	if ar.cache == nil {
+		return CacheStats{}
+	}
+	return ar.cache.stats()
 }
 
 func (ar *Reader) Close() error {
+	if ar.cache != nil {
+		unregisterCache(ar.cache)
+	}
 	return ar.file.Close()
 }
 
@@ -82,33 +272,120 @@ func (ar *Reader) Close() error {
 // ReadFromReader(nextOffset) if you want to read the next document, or
 // use the Scan() helper
 func ReadFromReader(reader io.ReaderAt, offset uint32, blockSize int) ([]byte, uint32, error) {
-	b, err := ReadFromReader64(reader, uint64(offset*PAD), blockSize)
+	f := defaultFormat()
+	return f.read(reader, offset, blockSize)
+}
+
+// Scan ReaderAt, if the callback returns error this error is returned as the Scan error
+func ScanFromReader(reader io.ReaderAt, offset uint32, blockSize int, cb func([]byte, uint32, uint32) error) error {
+	f := defaultFormat()
+	return f.scan(reader, offset, blockSize, ScanOptions{}, cb)
+}
+
+// Same as ScanFromReader, with options
+func ScanFromReaderWithOptions(reader io.ReaderAt, offset uint32, blockSize int, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	f := defaultFormat()
+	return f.scan(reader, offset, blockSize, opts, cb)
+}
+
+func (f *format) read(reader io.ReaderAt, offset uint32, blockSize int) ([]byte, uint32, error) {
+	data, next, err := f.readRecord(reader, offset, blockSize)
+	if err == errSkip {
+		// there is no record here, only filler for a failed append
+		return nil, 0, EBADSLT
+	}
+	return data, next, err
+}
+
+func (f *format) readInto(reader io.ReaderAt, offset uint32, blockSize int, dst []byte) ([]byte, uint32, error) {
+	block := getBlob(blockSize)
+	defer putBlob(block)
+
+	fr, next, buf, err := f.frameAtInto(reader, offset, blockSize, *block)
+	*block = buf
+	if err != nil {
+		return nil, 0, err
+	}
+	if fr.flags&flagSkip != 0 {
+		return nil, 0, EBADSLT
+	}
+	if fr.flags&flagDeleted != 0 {
+		return nil, next, ErrDeleted
+	}
+	dst, err = decompressInto(dst, fr.data, fr.flags)
 	if err != nil {
 		return nil, 0, err
 	}
-	nextOffset := (offset + ((uint32(16+len(b)))+PAD-1)/PAD)
-	return b, uint32(nextOffset), nil
+	return dst, next, nil
 }
 
-// Scan ReaderAt, if the callback returns error this error is returned as the Scan error
-func ScanFromReader(reader io.ReaderAt, offset uint32, blockSize int, cb func([]byte, uint32, uint32) error) error {
-	for {
-		data, next, err := ReadFromReader(reader, offset, blockSize)
-		if err == io.EOF {
-			return nil
-		}
-		if err == EBADSLT {
-			// assume corrupted file, so just skip until we find next valid entry
-			offset++
-			continue
-		}
+// same as read, but for skip records returns errSkip and the offset after the skipped space
+func (f *format) readRecord(reader io.ReaderAt, offset uint32, blockSize int) ([]byte, uint32, error) {
+	fr, next, err := f.frameAt(reader, offset, blockSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fr.flags&flagSkip != 0 {
+		return nil, next, errSkip
+	}
+	if fr.flags&flagDeleted != 0 {
+		return nil, next, ErrDeleted
+	}
+	b, err := decompress(fr.data, fr.flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	return b, next, nil
+}
+
+// reads the frame at offset, returns it and the offset after it
+func (f *format) frameAt(reader io.ReaderAt, offset uint32, blockSize int) (frame, uint32, error) {
+	fr, next, _, err := f.frameAtInto(reader, offset, blockSize, nil)
+	return fr, next, err
+}
+
+// same as frameAt, but reads into buf, see readFrameInto
+func (f *format) frameAtInto(reader io.ReaderAt, offset uint32, blockSize int, buf []byte) (frame, uint32, []byte, error) {
+	fr, buf, err := f.readFrameInto(reader, uint64(f.position(offset)), blockSize, buf)
+	if err != nil {
+		return frame{}, 0, buf, err
+	}
+	if fr.flags&flagSkip != 0 {
+		return fr, offset + fr.length, buf, nil
+	}
+	return fr, offset + f.units(len(fr.data)), buf, nil
+}
+
+func (f *format) scan(reader io.ReaderAt, offset uint32, blockSize int, opts ScanOptions, cb func([]byte, uint32, uint32) error) error {
+	it := f.iter(reader, offset, blockSize, opts)
+	defer it.Close()
+	if opts.Stats != nil {
+		defer func() {
+			*opts.Stats = it.Stats()
+		}()
+	}
+	for it.Next() {
+		err := cb(it.Data(), it.Offset(), it.NextOffset())
 		if err != nil {
 			return err
 		}
-		err = cb(data, offset, next)
+	}
+	return it.Err()
+}
+
+// calls cb with every live frame, jumps over skip records and resyncs after corruption
+func (f *format) scanFrames(reader io.ReaderAt, offset uint32, blockSize int, opts ScanOptions, cb func(frame, uint32, uint32) error) error {
+	it := f.iterFrames(reader, offset, blockSize, opts)
+	if opts.Stats != nil {
+		defer func() {
+			*opts.Stats = it.stats
+		}()
+	}
+	for it.next() {
+		err := cb(it.frame, it.offset, it.nextOffset)
 		if err != nil {
 			return err
 		}
-		offset = next
 	}
+	return it.err
 }
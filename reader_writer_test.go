@@ -8,8 +8,10 @@ import (
 	"math/rand"
 	"os"
 	"path"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -418,3 +420,650 @@ func TestReaderBadArgs(t *testing.T) {
 		panic(err)
 	}
 }
+
+func TestAppendBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fw, err := NewWriter(path.Join(dir, "forward"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	reader, err := NewReader(path.Join(dir, "forward"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	offsets, err := fw.AppendBatch(nil)
+	if err != nil || offsets != nil {
+		t.Fatalf("expected nil, got %v %v", offsets, err)
+	}
+
+	done := make(chan []Case)
+	for k := 0; k < 10; k++ {
+		go func(k int) {
+			out := []Case{}
+			for i := 0; i < 100; i++ {
+				data := []byte(RandStringRunes(i))
+				off, _, err := fw.Append(data)
+				if err != nil {
+					panic(err)
+				}
+				out = append(out, Case{document: off, data: data})
+
+				batch := [][]byte{}
+				for j := 0; j < k+1; j++ {
+					batch = append(batch, []byte(RandStringRunes(i+j)))
+				}
+				offsets, err := fw.AppendBatch(batch)
+				if err != nil {
+					panic(err)
+				}
+				if len(offsets) != len(batch) {
+					panic("offsets mismatch")
+				}
+				for j := range batch {
+					out = append(out, Case{document: offsets[j], data: batch[j]})
+				}
+			}
+			done <- out
+		}(k)
+	}
+	cases := []Case{}
+	for k := 0; k < 10; k++ {
+		cases = append(cases, <-done...)
+	}
+
+	for _, v := range cases {
+		data, _, err := reader.Read(v.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(v.data, data) {
+			t.Fatalf("data mismatch, expected %v got %v", v.data, data)
+		}
+	}
+
+	n := 0
+	err = reader.Scan(0, func(data []byte, offset, next uint32) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cases) {
+		t.Fatalf("expected %d got %d", len(cases), n)
+	}
+}
+
+func TestAppendSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, opts := range []WriterOptions{
+		WriterOptions{},
+		WriterOptions{GroupCommit: true},
+		WriterOptions{GroupCommit: true, GroupCommitWindow: time.Millisecond, GroupCommitMaxBatch: 8},
+	} {
+		fn := path.Join(dir, fmt.Sprintf("forward-%d", i))
+		fw, err := NewWriterWithOptions(fn, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := NewReader(fn, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// set before any AppendSync, the commit goroutine reads it only after the first request
+		fsyncs, callers, biggest := 0, 0, 0
+		if fw.group != nil {
+			fw.group.onBatch = func(n int) {
+				fsyncs++
+				callers += n
+				if n > biggest {
+					biggest = n
+				}
+			}
+		}
+
+		done := make(chan []Case)
+		for k := 0; k < 20; k++ {
+			go func() {
+				out := []Case{}
+				for i := 0; i < 50; i++ {
+					data := []byte(RandStringRunes(i))
+					off, _, err := fw.AppendSync(data)
+					if err != nil {
+						panic(err)
+					}
+					out = append(out, Case{document: off, data: data})
+				}
+				done <- out
+			}()
+		}
+		cases := []Case{}
+		for k := 0; k < 20; k++ {
+			cases = append(cases, <-done...)
+		}
+
+		if fw.group != nil {
+			if callers != len(cases) {
+				t.Fatalf("expected %d callers got %d", len(cases), callers)
+			}
+			// without a window sharing depends on how slow the fsync is, with one the callers always queue up
+			if opts.GroupCommitWindow > 0 && fsyncs >= callers {
+				t.Fatalf("expected shared fsyncs, got %d fsyncs for %d callers", fsyncs, callers)
+			}
+			if opts.GroupCommitMaxBatch > 0 && biggest > opts.GroupCommitMaxBatch {
+				t.Fatalf("batch of %d, more than %d", biggest, opts.GroupCommitMaxBatch)
+			}
+		}
+
+		for _, v := range cases {
+			data, _, err := reader.Read(v.document)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(v.data, data) {
+				t.Fatalf("data mismatch, expected %v got %v", v.data, data)
+			}
+		}
+
+		err = fw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = fw.AppendSync([]byte("closed"))
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		reader.Close()
+	}
+}
+
+func TestDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "f")
+
+	w, err := NewWriterWithOptions(filename, WriterOptions{Compression: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r, err := NewReader(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	cases := []Case{}
+	for i := 0; i < 100; i++ {
+		data := []byte(fmt.Sprintf("secret-%d-%s", i, RandStringRunes(i)))
+		off, next, err := w.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+	}
+
+	deleted := map[uint32]bool{}
+	for i := 0; i < 100; i += 3 {
+		err = w.Delete(cases[i].document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted[cases[i].document] = true
+	}
+	err = w.Delete(cases[0].document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range cases {
+		data, next, err := r.Read(v.document)
+		if deleted[v.document] {
+			if err != ErrDeleted {
+				t.Fatalf("expected ErrDeleted got %v", err)
+			}
+		} else {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(v.data, data) {
+				t.Fatalf("data mismatch, expected %s got %s", v.data, data)
+			}
+		}
+		if next != v.next {
+			t.Fatalf("expected %d got %d", v.next, next)
+		}
+	}
+
+	err = w.Overwrite(cases[0].document, []byte("x"))
+	if err != ErrDeleted {
+		t.Fatalf("expected ErrDeleted got %v", err)
+	}
+
+	n := 0
+	err = r.Scan(0, func(data []byte, offset, next uint32) error {
+		if deleted[offset] {
+			t.Fatalf("unexpected deleted record %d", offset)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cases)-len(deleted) {
+		t.Fatalf("expected %d got %d", len(cases)-len(deleted), n)
+	}
+
+	seen := 0
+	err = r.ScanWithOptions(0, ScanOptions{OnDeleted: func(offset, next uint32) error {
+		if !deleted[offset] {
+			t.Fatalf("unexpected live record %d", offset)
+		}
+		seen++
+		return nil
+	}}, func(data []byte, offset, next uint32) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(deleted) {
+		t.Fatalf("expected %d got %d", len(deleted), seen)
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, []byte("secret-3-")) || !bytes.Contains(content, []byte("secret-4-")) {
+		t.Fatal("expected deleted data to be erased")
+	}
+}
+
+func TestCompareAndOverwrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(path.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	off, _, err := w.Append([]byte(fmt.Sprintf("%010d", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	for k := 0; k < 10; k++ {
+		go func() {
+			conflicts := 0
+			for i := 0; i < 100; i++ {
+				for {
+					data, hash, err := w.ReadWithHash(off)
+					if err != nil {
+						panic(err)
+					}
+					var v int
+					fmt.Sscanf(string(data), "%d", &v)
+					err = w.CompareAndOverwrite(off, hash, []byte(fmt.Sprintf("%010d", v+1)))
+					if err == ESTALE {
+						conflicts++
+						continue
+					}
+					if err != nil {
+						panic(err)
+					}
+					break
+				}
+			}
+			done <- conflicts
+		}()
+	}
+	for k := 0; k < 10; k++ {
+		<-done
+	}
+
+	data, hash, err := w.ReadWithHash(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != fmt.Sprintf("%010d", 1000) {
+		t.Fatalf("expected 1000 got %s", data)
+	}
+
+	err = w.CompareAndOverwrite(off, hash+1, []byte("x"))
+	if err != ESTALE {
+		t.Fatalf("expected ESTALE got %v", err)
+	}
+	err = w.Delete(off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.CompareAndOverwrite(off, hash, []byte("x"))
+	if err != ErrDeleted {
+		t.Fatalf("expected ErrDeleted got %v", err)
+	}
+}
+
+func TestSafeOverwriteCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := path.Join(dir, "f")
+
+	oldValue := []byte(RandStringRunes(1000))
+	newValue := []byte(RandStringRunes(900))
+
+	// crash is called after the journal is written, it returns the value that has to survive
+	for _, crash := range []func(w *Writer, off uint32, blob []byte) []byte{
+		// crash before anything was written in place
+		func(w *Writer, off uint32, blob []byte) []byte {
+			return oldValue
+		},
+		// torn write in place
+		func(w *Writer, off uint32, blob []byte) []byte {
+			_, err := w.file.WriteAt(blob[:len(blob)/2], int64(off*PAD))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newValue
+		},
+		// only the header was written
+		func(w *Writer, off uint32, blob []byte) []byte {
+			_, err := w.file.WriteAt(blob[:16], int64(off*PAD))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newValue
+		},
+		// in place write finished, but the journal was not cleared
+		func(w *Writer, off uint32, blob []byte) []byte {
+			_, err := w.file.WriteAt(blob, int64(off*PAD))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newValue
+		},
+		// torn journal, nothing in place
+		func(w *Writer, off uint32, blob []byte) []byte {
+			err := w.journal.Truncate(100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return oldValue
+		},
+	} {
+		os.Remove(filename)
+		w, err := NewWriter(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = w.Append([]byte("before"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		off, _, err := w.Append(oldValue)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = w.Append([]byte("after"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blob := make([]byte, 16+len(newValue))
+		w.format.putFrame(blob, newValue, 0)
+		err = w.writeJournal(int64(off*PAD), blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := crash(w, off, blob)
+		w.Close()
+
+		w, err = NewWriter(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewReader(filename, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, err := r.Read(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, expected) {
+			t.Fatal("mismatch")
+		}
+		n := 0
+		err = r.Scan(0, func(data []byte, offset, next uint32) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 3 {
+			t.Fatalf("expected 3 got %d", n)
+		}
+
+		// and without crashing
+		err = w.SafeOverwrite(off, []byte("short"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _, err = r.Read(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "short" {
+			t.Fatalf("expected short got %s", data)
+		}
+		err = w.SafeOverwrite(off, oldValue)
+		if err != EOVERFLOW {
+			t.Fatalf("expected EOVERFLOW got %v", err)
+		}
+		st, err := os.Stat(filename + ".journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() != 0 {
+			t.Fatalf("expected empty journal, got %d", st.Size())
+		}
+		r.Close()
+		w.Close()
+	}
+}
+
+// hides New, so AppendV has to take the fallback path
+type plainHasher struct {
+	Hasher
+}
+
+func TestAppendV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	many := [][]byte{}
+	for i := 0; i < 2000; i++ {
+		many = append(many, []byte(RandStringRunes(i%7)))
+	}
+	inputs := [][][]byte{
+		nil,
+		{[]byte("hello world")},
+		{[]byte("proto"), nil, []byte("key"), []byte(strings.Repeat("value", 1000))},
+		many,
+	}
+
+	for i, opts := range []WriterOptions{
+		{},
+		{Superblock: true, Hasher: CRC32CHasher},
+		{Superblock: true, Hasher: XXHasher},
+		{Compression: Deflate},
+		{Hasher: plainHasher{MetroHasher}},
+	} {
+		fn := path.Join(dir, fmt.Sprintf("forward%d", i))
+		fw, err := NewWriterWithOptions(fn, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := NewReaderWithOptions(fn, ReaderOptions{Hasher: opts.Hasher})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, parts := range inputs {
+			off, next, err := fw.AppendV(parts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, rnext, err := reader.Read(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if next != rnext || !bytes.Equal(data, bytes.Join(parts, nil)) {
+				t.Fatalf("mismatch at %d", off)
+			}
+		}
+
+		if i == 0 && !raceEnabled {
+			// the digest, the buffers and the iovecs are pooled
+			parts := inputs[2]
+			allocs := testing.AllocsPerRun(100, func() {
+				_, _, err = fw.AppendV(parts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+			if allocs >= 1 {
+				t.Fatalf("expected no allocations, got %v", allocs)
+			}
+		}
+
+		fw.Close()
+		reader.Close()
+	}
+}
+
+func TestReadIntoAndReuseBuffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Compression: Deflate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	reader, err := NewReader(fn, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	cases := []Case{}
+	for i := 0; i < 200; i++ {
+		// random bytes do not compress, so they are stored raw between the compressed ones
+		data := make([]byte, i*13)
+		rand.Read(data)
+		if i%2 == 0 {
+			data = []byte(strings.Repeat("abc", i*10))
+		}
+		off, next, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+	}
+	for _, i := range []int{99, 100} {
+		v := cases[i]
+		fr, err := reader.format.readFrame(reader.file, uint64(reader.format.position(v.document)), 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (fr.flags&flagCompressed != 0) != (i%2 == 0) {
+			t.Fatalf("unexpected flags %x at %d", fr.flags, v.document)
+		}
+	}
+
+	var buf []byte
+	var next uint32
+	for _, v := range cases {
+		buf, next, err = reader.ReadInto(v.document, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != v.next || !bytes.Equal(buf, v.data) {
+			t.Fatalf("mismatch at %d", v.document)
+		}
+	}
+
+	buf = make([]byte, 0, 4096)
+	last := cases[len(cases)-1]
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, _, err = reader.ReadInto(last.document, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs >= 1 {
+		t.Fatalf("expected no allocations, got %v", allocs)
+	}
+
+	err = fw.Delete(cases[1].document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = reader.ReadInto(cases[1].document, buf)
+	if err != ErrDeleted {
+		t.Fatalf("expected ErrDeleted got %v", err)
+	}
+
+	i := 0
+	err = reader.ScanWithOptions(0, ScanOptions{ReuseBuffer: true}, func(data []byte, offset, next uint32) error {
+		if i == 1 {
+			i++
+		}
+		if offset != cases[i].document || !bytes.Equal(data, cases[i].data) {
+			t.Fatalf("mismatch at %d", offset)
+		}
+		i++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(cases) {
+		t.Fatalf("expected %d got %d", len(cases), i)
+	}
+}
@@ -0,0 +1,43 @@
+package pen
+
+import (
+	"os"
+)
+
+// scans forward from the known good offset and truncates everything after the last valid record
+// returns the new file size
+func (f *format) recover(file *os.File, from uint32, size int64, report func(uint32, int64)) (int64, error) {
+	if from < f.start {
+		from = f.start
+	}
+	if f.position(from) >= size {
+		return size, nil
+	}
+
+	end := from
+	// only the frames are needed, not the decompressed data
+	err := f.scanFrames(file, from, 4096, ScanOptions{OnDeleted: func(offset, next uint32) error {
+		end = next
+		return nil
+	}}, func(fr frame, offset, next uint32) error {
+		end = next
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// the padding after the last record is not written, so the file can be shorter than next
+	if f.position(end) >= size {
+		return size, nil
+	}
+
+	err = file.Truncate(f.position(end))
+	if err != nil {
+		return 0, err
+	}
+	if report != nil {
+		report(end, size-f.position(end))
+	}
+	return f.position(end), nil
+}
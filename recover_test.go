@@ -0,0 +1,119 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRecoverTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []Case{}
+	for i := 0; i < 100; i++ {
+		data := []byte(RandStringRunes(i))
+		off, next, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+	}
+
+	// corrupt one in the middle, it should be kept
+	_, err = fw.file.WriteAt([]byte{0xff}, int64(cases[50].document*PAD)+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// half written record at the end
+	torn := make([]byte, 16+1000)
+	f := defaultFormat()
+	f.putFrame(torn, bytes.Repeat([]byte{'a'}, 1000), 0)
+	tornOffset := cases[len(cases)-1].next
+	_, err = fw.file.WriteAt(torn[:500], int64(tornOffset*PAD))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Close()
+
+	// without recovery the next append lands after the garbage
+	fw, err = NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fw.offset == tornOffset {
+		t.Fatal("expected offset after the torn record")
+	}
+	fw.Close()
+
+	reported := false
+	fw, err = NewWriterWithOptions(fn, WriterOptions{Recover: true, OnRecover: func(offset uint32, discarded int64) {
+		reported = true
+		if offset != tornOffset {
+			t.Fatalf("expected %d got %d", tornOffset, offset)
+		}
+		if discarded != 500 {
+			t.Fatalf("expected 500 got %d", discarded)
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reported {
+		t.Fatal("expected report")
+	}
+	off, _, err := fw.Append([]byte("after recovery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != tornOffset {
+		t.Fatalf("expected %d got %d", tornOffset, off)
+	}
+	fw.Close()
+
+	// nothing to recover now, also starting from known good offset
+	for _, from := range []uint32{0, cases[80].document} {
+		fw, err = NewWriterWithOptions(fn, WriterOptions{Recover: true, RecoverFrom: from, OnRecover: func(offset uint32, discarded int64) {
+			t.Fatalf("unexpected recovery at %d", offset)
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Close()
+	}
+
+	reader, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	n := 0
+	err = reader.Scan(0, func(data []byte, offset, next uint32) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cases) {
+		t.Fatalf("expected %d got %d", len(cases), n)
+	}
+	data, _, err := reader.Read(tornOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "after recovery" {
+		t.Fatalf("unexpected %s", data)
+	}
+}
@@ -0,0 +1,80 @@
+package pen
+
+import (
+	"bytes"
+	"io"
+	"math"
+)
+
+// how much is read at once while looking for the next header after corruption
+const resyncWindow = 1 << 20
+
+// finds the first offset at or after offset (and before end, 0 means no limit) with a header that looks valid (MAGIC and header checksum),
+// by searching MAGIC in big windows instead of reading one block per offset. The data is not verified, frameAt does that.
+// If there is none it returns the first offset whose header does not fit in the file (or end), so frameAt there returns io.EOF.
+// returns buf so it can be reused
+func (f *format) resync(reader io.ReaderAt, offset uint32, end uint32, buf []byte) (uint32, []byte, error) {
+	size := resyncWindow
+	if int64(size) < int64(f.pad)+16 {
+		size = int(f.pad) + 16
+	}
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	pad := int(f.pad)
+
+	for {
+		if end != 0 && offset >= end {
+			return end, buf, nil
+		}
+		n, err := reader.ReadAt(buf, f.position(offset))
+		if err != nil && err != io.EOF {
+			return 0, buf, err
+		}
+		window := buf[:n]
+
+		for searched := 0; ; {
+			i := bytes.Index(window[searched:], f.magic)
+			if i < 0 {
+				break
+			}
+			// MAGIC is at +8 in the header, and headers are PAD aligned
+			header := searched + i - 8
+			searched += i + 1
+			if header < 0 || header%pad != 0 {
+				continue
+			}
+			if header+16 > len(window) {
+				// the next window starts with it
+				break
+			}
+			candidate := uint64(offset) + uint64(header/pad)
+			if end != 0 && candidate >= uint64(end) {
+				return end, buf, nil
+			}
+			if candidate > math.MaxUint32 {
+				break
+			}
+			if _, err := f.parseHeader(window[header : header+16]); err == nil {
+				return uint32(candidate), buf, nil
+			}
+		}
+
+		// how many offsets have their whole header in the window, those are checked
+		checked := 0
+		if len(window) >= 16 {
+			checked = (len(window)-16)/pad + 1
+		}
+		if uint64(offset)+uint64(checked) > math.MaxUint32 {
+			return math.MaxUint32, buf, nil
+		}
+		offset += uint32(checked)
+		if end != 0 && offset >= end {
+			return end, buf, nil
+		}
+		if n < len(buf) {
+			return offset, buf, nil
+		}
+	}
+}
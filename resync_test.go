@@ -0,0 +1,136 @@
+package pen
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFastResync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	r, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	before, _, err := fw.Append([]byte("before"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 5MB of garbage, with MAGIC at aligned and misaligned positions and a valid header in front of wrong data
+	garbage := make([]byte, 5<<20)
+	rand.Read(garbage)
+	for i := 0; i < 1000; i++ {
+		at := rand.Intn(len(garbage) - 16)
+		if i%2 == 0 {
+			at -= at % int(PAD)
+		}
+		copy(garbage[at+8:], MAGIC)
+	}
+	fw.format.putHeader(garbage[int(PAD)*1000:], 100, 0, 12345)
+	hole, err := fw.reserve(uint32(len(garbage)) / PAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.file.WriteAt(garbage, fw.format.position(hole))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, _, err := fw.Append([]byte("after"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &countingReaderAt{r: r.file}
+	offsets := []uint32{}
+	regions := []region{}
+	opts := ScanOptions{OnCorruption: func(start, end uint32, err error) {
+		regions = append(regions, region{start, end})
+	}}
+	err = ScanFromReaderWithOptions(counting, 0, 16, opts, func(data []byte, offset, next uint32) error {
+		offsets = append(offsets, offset)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(offsets) != 2 || offsets[0] != before || offsets[1] != after {
+		t.Fatalf("unexpected offsets %v", offsets)
+	}
+	if len(regions) != 1 || regions[0] != (region{hole, after}) {
+		t.Fatalf("expected corruption from %d to %d got %v", hole, after, regions)
+	}
+	if reads := atomic.LoadInt64(&counting.reads); reads > 20 {
+		t.Fatalf("expected few reads, got %d", reads)
+	}
+
+	// the same offsets as checking every offset one by one
+	f := defaultFormat()
+	for offset := before; offset < after; offset += 9973 {
+		expected := offset
+		for {
+			_, _, err := f.frameAt(r.file, expected, 16)
+			if err != EBADSLT {
+				break
+			}
+			expected++
+		}
+		got, _, err := f.resync(r.file, offset, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for {
+			_, _, err := f.frameAt(r.file, got, 16)
+			if err != EBADSLT {
+				break
+			}
+			got, _, err = f.resync(r.file, got+1, 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got != expected {
+			t.Fatalf("from %d expected %d got %d", offset, expected, got)
+		}
+	}
+
+	// nothing to find, it stops where frameAt returns EOF
+	zeroes := bytes.NewReader(make([]byte, 1000))
+	got, _, err := f.resync(zeroes, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = f.frameAt(zeroes, got, 16)
+	if err != io.EOF || f.position(got-1)+16 > 1000 {
+		t.Fatalf("expected the first offset at the end, got %d %v", got, err)
+	}
+
+	// and never past end, even when the file ends first or the next header is after it
+	got, _, err = f.resync(zeroes, 0, 3, nil)
+	if err != nil || got != 3 {
+		t.Fatalf("expected 3 got %d %v", got, err)
+	}
+	got, _, err = f.resync(r.file, before+1, before+2, nil)
+	if err != nil || got != before+2 {
+		t.Fatalf("expected %d got %d %v", before+2, got, err)
+	}
+}
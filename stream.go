@@ -0,0 +1,220 @@
+package pen
+
+import (
+	"bytes"
+	"compress/flate"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// how much of the AppendFrom input is kept in memory before spooling it to a temporary file
+const appendFromBuffer = 1 << 20
+
+// AppendFrom appends everything read from r until EOF, without keeping all of it in memory.
+// Small inputs are appended exactly like Append. Bigger ones are spooled to a temporary file in the directory of
+// the pen file while the checksum is computed (and the data compressed), because the size is not known upfront.
+// Only then the space is reserved and the spool is copied in, so concurrent appends are not blocked while r is read.
+// The header is written after the data, so nobody sees a valid header in front of incomplete data.
+// The stored size is still limited to 256MB, reading stops with EMSGSIZE as soon as it goes over, and a Hasher
+// that is not a StreamHasher needs the whole record in memory.
+// With compression the spooled records are always stored compressed.
+func (fw *Writer) AppendFrom(r io.Reader) (uint32, uint32, error) {
+	// grows with the input, so small ones do not pay for the whole buffer
+	var head bytes.Buffer
+	n, err := head.ReadFrom(io.LimitReader(r, appendFromBuffer))
+	if err != nil {
+		return 0, 0, err
+	}
+	if n < appendFromBuffer {
+		return fw.Append(head.Bytes())
+	}
+	buf := head.Bytes()
+
+	sh, ok := fw.format.hasher.(StreamHasher)
+	if !ok {
+		if fw.compression != Deflate {
+			// without compression anything over the limit is refused anyway, do not read more than that
+			r = io.LimitReader(r, maxRecordSize+1-appendFromBuffer)
+		}
+		rest, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, 0, err
+		}
+		if fw.compression != Deflate && len(buf)+len(rest) > maxRecordSize {
+			return 0, 0, EMSGSIZE
+		}
+		return fw.Append(append(buf, rest...))
+	}
+
+	spool, err := ioutil.TempFile(filepath.Dir(fw.file.Name()), ".pen-spool-")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	h := sh.New()
+	counter := &countingWriter{w: io.MultiWriter(spool, h), limit: maxRecordSize}
+	var dst io.Writer = counter
+	flags := uint32(0)
+	var zw *flate.Writer
+	if fw.compression == Deflate {
+		zw = flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(zw)
+		zw.Reset(counter)
+		dst = zw
+		flags = flagCompressed
+	}
+
+	_, err = dst.Write(buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = io.CopyBuffer(dst, r, buf)
+	if err != nil {
+		return 0, 0, err
+	}
+	if zw != nil {
+		err = zw.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	padded := fw.format.units(int(counter.n))
+	current, err := fw.reserve(padded)
+	if err != nil {
+		return 0, 0, err
+	}
+	position := fw.format.position(current)
+
+	_, err = spool.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyBuffer(&sectionWriter{w: fw.file, offset: position + 16}, spool, buf)
+	}
+	if err == nil {
+		header := make([]byte, 16)
+		fw.format.putHeader(header, uint32(counter.n), flags, uint32(h.Sum64()))
+		_, err = fw.file.WriteAt(header, position)
+	}
+	if err != nil {
+		fw.fillHole(current, padded)
+		return 0, 0, err
+	}
+	return current, current + padded, nil
+}
+
+// counts what goes through, and refuses to go over limit with EMSGSIZE
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	limit int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.n+int64(len(b)) > c.limit {
+		return 0, EMSGSIZE
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type sectionWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *sectionWriter) Write(b []byte) (int, error) {
+	n, err := o.w.WriteAt(b, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// Open streams the record at offset, instead of reading it all in memory.
+// The checksum is verified when the end is reached: if the record is corrupted Read returns EBADSLT instead of io.EOF,
+// and you should throw away what you have read. Compressed records are decompressed transparently.
+// Closing it does not close the Reader.
+func (ar *Reader) Open(offset uint32) (io.ReadCloser, error) {
+	return ar.format.open(ar.file, offset)
+}
+
+func (f *format) open(reader io.ReaderAt, offset uint32) (io.ReadCloser, error) {
+	header := getBlob(16)
+	defer putBlob(header)
+	_, err := reader.ReadAt(*header, f.position(offset))
+	if err != nil {
+		return nil, err
+	}
+	fr, err := f.parseHeader(*header)
+	if err != nil {
+		return nil, err
+	}
+	if fr.flags&flagSkip != 0 {
+		return nil, EBADSLT
+	}
+	if fr.flags&flagDeleted != 0 {
+		return nil, ErrDeleted
+	}
+
+	section := io.NewSectionReader(reader, f.position(offset)+16, int64(fr.length))
+	var src io.Reader
+	if sh, ok := f.hasher.(StreamHasher); ok {
+		src = &verifyingReader{r: section, h: sh.New(), expected: fr.hash}
+	} else {
+		data := make([]byte, fr.length)
+		_, err = io.ReadFull(section, data)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(f.hasher.Sum64(data)) != fr.hash {
+			return nil, EBADSLT
+		}
+		src = bytes.NewReader(data)
+	}
+
+	if fr.flags&flagCompressed == 0 {
+		return ioutil.NopCloser(src), nil
+	}
+	return &inflatingReader{zr: flate.NewReader(src), src: src}, nil
+}
+
+// hashes everything it reads, and returns EBADSLT instead of io.EOF if the checksum does not match
+type verifyingReader struct {
+	r        io.Reader
+	h        hash.Hash64
+	expected uint32
+}
+
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+	if err == io.EOF && uint32(v.h.Sum64()) != v.expected {
+		return n, EBADSLT
+	}
+	return n, err
+}
+
+type inflatingReader struct {
+	zr  io.ReadCloser
+	src io.Reader
+}
+
+func (i *inflatingReader) Read(b []byte) (int, error) {
+	n, err := i.zr.Read(b)
+	if err != nil {
+		// flate can stop before the end of the stored data, make sure all of it went through the checksum
+		_, drainErr := io.Copy(ioutil.Discard, i.src)
+		if drainErr != nil {
+			return n, drainErr
+		}
+	}
+	return n, err
+}
+
+func (i *inflatingReader) Close() error {
+	return i.zr.Close()
+}
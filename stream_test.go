@@ -0,0 +1,195 @@
+package pen
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestAppendFromAndOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	big := make([]byte, 3*appendFromBuffer+17)
+	rand.Read(big)
+	text := []byte(strings.Repeat(`{"hello":"world"}`, appendFromBuffer/8))
+	small := []byte("hello world")
+
+	for i, h := range []Hasher{MetroHasher, CRC32CHasher, XXHasher} {
+		for _, c := range []Compression{NoCompression, Deflate} {
+			fn := path.Join(dir, strings.Repeat("x", i+1)+string(rune('a'+c)))
+			w, err := NewWriterWithOptions(fn, WriterOptions{Superblock: true, Hasher: h, Compression: c})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewReader(fn, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, data := range [][]byte{big, small, text} {
+				off, next, err := w.AppendFrom(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				read, rnext, err := r.Read(off)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rnext != next || !bytes.Equal(read, data) {
+					t.Fatalf("mismatch at %d", off)
+				}
+
+				rc, err := r.Open(off)
+				if err != nil {
+					t.Fatal(err)
+				}
+				streamed, err := ioutil.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(streamed, data) {
+					t.Fatalf("stream mismatch at %d", off)
+				}
+			}
+
+			w.Close()
+			r.Close()
+		}
+	}
+}
+
+func TestAppendFromSmallAllocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewWriter(path.Join(dir, "forward"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	small := []byte("hello world")
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100; i++ {
+		_, _, err := w.AppendFrom(bytes.NewReader(small))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 100*64<<10 {
+		t.Fatalf("allocated %d bytes for 100 small records", allocated)
+	}
+}
+
+func TestOpenCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	for _, c := range []Compression{NoCompression, Deflate} {
+		w, err := NewWriterWithOptions(fn, WriterOptions{Compression: c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		r, err := NewReader(fn, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		off, _, err := w.AppendFrom(strings.NewReader(strings.Repeat("abc", appendFromBuffer)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// corrupt one byte of the stored data
+		_, err = w.file.WriteAt([]byte{0xff}, int64(off)*int64(PAD)+16+100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rc, err := r.Open(off)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != EBADSLT {
+			t.Fatalf("expected EBADSLT got %v", err)
+		}
+	}
+}
+
+// endless input, counts how much was read from it
+type endlessReader struct {
+	n int64
+}
+
+func (e *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	e.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestAppendFromTooLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes 256MB")
+	}
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i, h := range []Hasher{MetroHasher, plainHasher{MetroHasher}} {
+		fn := path.Join(dir, strings.Repeat("x", i+1))
+		w, err := NewWriterWithOptions(fn, WriterOptions{Hasher: h})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := &endlessReader{}
+		_, _, err = w.AppendFrom(r)
+		if err != EMSGSIZE {
+			t.Fatalf("expected EMSGSIZE got %v", err)
+		}
+		if r.n > maxRecordSize+2*appendFromBuffer {
+			t.Fatalf("read %d bytes after the limit", r.n-maxRecordSize)
+		}
+		if w.offset != 0 {
+			t.Fatalf("expected nothing appended, offset %d", w.offset)
+		}
+		w.Close()
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".pen-spool-") {
+			t.Fatalf("spool %s left behind", f.Name())
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package pen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ENOTSUP = errors.New("unsupported file format")
+
+// Optional file header, NewWriterWithOptions writes it when WriterOptions.Superblock is set and the file is empty.
+// format is:
+//
+//	8 bytes signature "go-pen\x00\x00"
+//	4 bytes LE format version
+//	4 bytes LE PAD
+//	4 bytes MAGIC
+//	4 bytes LE hash algorithm // Hasher.ID()
+//	32 bytes reserved
+//	8 bytes LE go-metro hash of the first 56 bytes
+//
+// The first record starts after the superblock (rounded up to PAD), files without it are read with the package PAD and MAGIC
+// (and go-metro, unless you pass a Hasher in the options)
+const SuperblockSize = 64
+
+const formatVersion = 1
+
+var superblockSignature = []byte("go-pen\x00\x00")
+
+// per file settings, taken from the superblock or from the package globals for legacy files
+type format struct {
+	pad    uint32
+	magic  []byte
+	hasher Hasher
+	// first record offset, in pad units
+	start uint32
+}
+
+func defaultFormat() format {
+	return format{pad: PAD, magic: MAGIC, hasher: MetroHasher}
+}
+
+func newFormat(pad uint32, magic []byte, hasher Hasher, superblock bool) format {
+	f := format{pad: pad, magic: magic, hasher: hasher}
+	if superblock {
+		f.start = (SuperblockSize + pad - 1) / pad
+	}
+	return f
+}
+
+// how many pad units header + stored bytes take
+func (f *format) units(storedLen int) uint32 {
+	return (uint32(16+storedLen) + f.pad - 1) / f.pad
+}
+
+// byte position of an offset
+func (f *format) position(offset uint32) int64 {
+	return int64(offset) * int64(f.pad)
+}
+
+func (f *format) encodeSuperblock() []byte {
+	b := make([]byte, SuperblockSize)
+	copy(b, superblockSignature)
+	binary.LittleEndian.PutUint32(b[8:], formatVersion)
+	binary.LittleEndian.PutUint32(b[12:], f.pad)
+	copy(b[16:20], f.magic)
+	binary.LittleEndian.PutUint32(b[20:], f.hasher.ID())
+	binary.LittleEndian.PutUint64(b[56:], Hash(b[:56]))
+	return b
+}
+
+// reads the superblock, returns false if the file does not have one
+// custom is used if the file was written with a hasher that is not built in
+func readSuperblock(reader io.ReaderAt, custom Hasher) (format, bool, error) {
+	b := make([]byte, SuperblockSize)
+	n, err := reader.ReadAt(b, 0)
+	if n < len(superblockSignature) || !bytes.Equal(b[:len(superblockSignature)], superblockSignature) {
+		if err != nil && err != io.EOF {
+			return format{}, false, err
+		}
+		return format{}, false, nil
+	}
+	if n < SuperblockSize {
+		return format{}, false, EBADSLT
+	}
+
+	if binary.LittleEndian.Uint64(b[56:]) != Hash(b[:56]) {
+		return format{}, false, EBADSLT
+	}
+	if binary.LittleEndian.Uint32(b[8:]) != formatVersion {
+		return format{}, false, ENOTSUP
+	}
+	pad := binary.LittleEndian.Uint32(b[12:])
+	if pad == 0 {
+		return format{}, false, ENOTSUP
+	}
+	hasher, err := hasherByID(binary.LittleEndian.Uint32(b[20:]), custom)
+	if err != nil {
+		return format{}, false, err
+	}
+
+	magic := make([]byte, 4)
+	copy(magic, b[16:20])
+	return newFormat(pad, magic, hasher, true), true, nil
+}
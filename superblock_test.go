@@ -0,0 +1,128 @@
+package pen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSuperblock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	fw, err := NewWriterWithOptions(fn, WriterOptions{Superblock: true, Pad: 16, Magic: []byte{1, 2, 3, 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []Case{}
+	for i := 0; i < 100; i++ {
+		data := []byte(RandStringRunes(i))
+		off, next, err := fw.Append(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if off < SuperblockSize/16 {
+			t.Fatalf("record %d overlaps the superblock", off)
+		}
+		cases = append(cases, Case{document: off, next: next, data: data})
+	}
+	err = fw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the file knows its own settings, so changing the globals does not matter
+	defer func(pad uint32, magic []byte) {
+		PAD = pad
+		MAGIC = magic
+	}(PAD, MAGIC)
+	PAD = 128
+	MAGIC = []byte{5, 6, 7, 8}
+
+	fw, err = NewWriter(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.Close()
+	off, next, err := fw.Append([]byte("reopened"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if off != cases[len(cases)-1].next {
+		t.Fatalf("expected %d got %d", cases[len(cases)-1].next, off)
+	}
+	cases = append(cases, Case{document: off, next: next, data: []byte("reopened")})
+
+	reader, err := NewReader(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	for _, v := range cases {
+		data, next, err := reader.Read(v.document)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != v.next {
+			t.Fatalf("expected %d got %d", v.next, next)
+		}
+		if !bytes.Equal(v.data, data) {
+			t.Fatalf("data mismatch, expected %s got %s", v.data, data)
+		}
+	}
+
+	n := 0
+	err = reader.Scan(0, func(data []byte, offset, next uint32) error {
+		if offset != cases[n].document {
+			t.Fatalf("expected %d got %d", cases[n].document, offset)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(cases) {
+		t.Fatalf("expected %d got %d", len(cases), n)
+	}
+
+	// corrupt the superblock
+	_, err = fw.file.WriteAt([]byte{0xff}, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewReader(fn, 0)
+	if err != EBADSLT {
+		t.Fatalf("expected EBADSLT got %v", err)
+	}
+	_, err = NewWriter(fn)
+	if err != EBADSLT {
+		t.Fatalf("expected EBADSLT got %v", err)
+	}
+}
+
+func TestSuperblockBadOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "forward")
+
+	_, err = NewWriterWithOptions(fn, WriterOptions{Pad: 16})
+	if err != EINVAL {
+		t.Fatalf("expected EINVAL got %v", err)
+	}
+	_, err = NewWriterWithOptions(fn, WriterOptions{Superblock: true, Magic: []byte{1}})
+	if err != EINVAL {
+		t.Fatalf("expected EINVAL got %v", err)
+	}
+}
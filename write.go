@@ -3,11 +3,30 @@ package pen
 import (
 	"encoding/binary"
 	"errors"
+	"hash"
+	"math"
 	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var EOVERFLOW = errors.New("you can only overwrite with smaller or equal size")
+var EMSGSIZE = errors.New("record too large")
+var EFBIG = errors.New("file too large, offset would not fit in 32 bits")
+var ESTALE = errors.New("record was modified, data hash does not match")
+
+// the top 4 bits of the length in the header are flags, so records are limited to 256MB (see Append)
+const maxRecordSize = 1<<28 - 1
+
+// at most one is set, parseHeader rejects bit 28 (unused) and combinations as corruption
+const (
+	flagCompressed = uint32(1 << 31)
+	// filler for space that was reserved but never written, the length is how many PAD units to skip
+	flagSkip = uint32(1 << 30)
+	// tombstone, the data is zeroed
+	flagDeleted = uint32(1 << 29)
+)
 
 // the offsets are 32 bit, but usually you want to store more than 4gb of data
 // so we just pad things to minimum 64 byte chunks
@@ -17,8 +36,64 @@ var PAD = uint32(64)
 var MAGIC = []byte{0xb, 0xe, 0xe, 0xf}
 
 type Writer struct {
-	file   *os.File
-	offset uint32
+	file        *os.File
+	offset      uint32
+	format      format
+	group       *groupCommit
+	compression Compression
+	// to find the caches of Readers of the same file, see ReaderOptions.CacheBytes
+	info os.FileInfo
+
+	// Overwrite, CompareAndOverwrite and Delete of the same offset are serialized
+	locks [64]sync.Mutex
+
+	// SafeOverwrite journal, opened on first use
+	journal     *os.File
+	journalLock sync.Mutex
+
+	// hash.Hash64 of the StreamHasher, reused by AppendV
+	digests sync.Pool
+}
+
+// Options for NewWriterWithOptions, the zero value gives you the same writer as NewWriter
+type WriterOptions struct {
+	// Enables group commit for AppendSync: concurrent AppendSync calls share a single fsync
+	GroupCommit bool
+
+	// How long to wait for more AppendSync calls before issuing the fsync, 0 means
+	// only the ones that queued up while the previous fsync was running are coalesced
+	GroupCommitWindow time.Duration
+
+	// Maximum amount of records waiting for one fsync, 0 means 256
+	GroupCommitMaxBatch int
+
+	// Compress records on Append, Reader decompresses transparently. Records that do not get smaller are stored raw
+	Compression Compression
+
+	// Write a superblock (see SuperblockSize) if the file is empty, so the file records its own PAD and MAGIC.
+	// If the file already has a superblock its settings are used regardless of the options.
+	Superblock bool
+
+	// PAD and MAGIC for new files with superblock, 0/nil means the package PAD and MAGIC
+	Pad   uint32
+	Magic []byte
+
+	// Checksum algorithm, nil means MetroHasher. It is recorded in the superblock,
+	// without superblock the readers have to be given the same hasher.
+	Hasher Hasher
+
+	// Validate the records from RecoverFrom to the end of the file and truncate everything after
+	// the last valid one, so a record torn by a crash does not end up in front of new appends.
+	// Corrupted records in the middle are kept, only the tail is discarded.
+	// Readers that are already open keep working, but an MmapReader may have the truncated tail mapped,
+	// it recovers from the fault (see MmapReader) though it is cheaper to open it after the Writer.
+	Recover bool
+
+	// Known good offset to start the recovery from (e.g. your last checkpoint), 0 means the start of the file
+	RecoverFrom uint32
+
+	// Called when Recover discarded something, with the offset where the torn tail started and how many bytes were truncated
+	OnRecover func(offset uint32, discarded int64)
 }
 
 // Creates new writer and seeks to the end
@@ -47,26 +122,121 @@ type Writer struct {
 //	log.Printf("%s",string(data))
 //
 func NewWriter(filename string) (*Writer, error) {
+	return NewWriterWithOptions(filename, WriterOptions{})
+}
+
+func NewWriterFromFile(fd *os.File) (*Writer, error) {
+	return NewWriterFromFileWithOptions(fd, WriterOptions{})
+}
+
+// Creates new writer with options, example:
+//
+//	w, err := NewWriterWithOptions(filename, WriterOptions{GroupCommit: true, GroupCommitWindow: time.Millisecond})
+//	if err != nil {
+//		panic(err)
+//	}
+//	// returns only after the record is on disk
+//	docID, _, err := w.AppendSync([]byte("hello world"))
+//	if err != nil {
+//		panic(err)
+//	}
+func NewWriterWithOptions(filename string, opts WriterOptions) (*Writer, error) {
 	fd, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
 	}
-	return NewWriterFromFile(fd)
+	fw, err := NewWriterFromFileWithOptions(fd, opts)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fw, nil
 }
 
-func NewWriterFromFile(fd *os.File) (*Writer, error) {
+func NewWriterFromFileWithOptions(fd *os.File, opts WriterOptions) (*Writer, error) {
+	if (opts.Pad != 0 || opts.Magic != nil) && !opts.Superblock {
+		return nil, EINVAL
+	}
+	if opts.Magic != nil && len(opts.Magic) != 4 {
+		return nil, EINVAL
+	}
+
+	f, ok, err := readSuperblock(fd, opts.Hasher)
+	if err != nil {
+		return nil, err
+	}
+
 	off, err := fd.Seek(0, os.SEEK_END)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Writer{
-		file:   fd,
-		offset: uint32((off + int64(PAD) - 1) / int64(PAD)),
-	}, nil
+	if !ok {
+		f = defaultFormat()
+		if opts.Hasher != nil {
+			f.hasher = opts.Hasher
+		}
+		if opts.Superblock && off == 0 {
+			if opts.Pad != 0 {
+				f.pad = opts.Pad
+			}
+			if opts.Magic != nil {
+				f.magic = opts.Magic
+			}
+			f = newFormat(f.pad, f.magic, f.hasher, true)
+			_, err = fd.WriteAt(f.encodeSuperblock(), 0)
+			if err != nil {
+				return nil, err
+			}
+			off = SuperblockSize
+		}
+	}
+
+	err = f.replayJournal(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Recover {
+		off, err = f.recover(fd, opts.RecoverFrom, off, opts.OnRecover)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	units := (off + int64(f.pad) - 1) / int64(f.pad)
+	if units > math.MaxUint32 {
+		return nil, EFBIG
+	}
+	if units < int64(f.start) {
+		units = int64(f.start)
+	}
+
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	fw := &Writer{
+		file:        fd,
+		offset:      uint32(units),
+		format:      f,
+		compression: opts.Compression,
+		info:        info,
+	}
+	if opts.GroupCommit {
+		fw.group = newGroupCommit(fd, opts.GroupCommitWindow, opts.GroupCommitMaxBatch)
+	}
+	return fw, nil
 }
 
 func (fw *Writer) Close() error {
+	if fw.group != nil {
+		fw.group.close()
+	}
+	if fw.journal != nil {
+		fw.journal.Close()
+	}
 	return fw.file.Close()
 }
 
@@ -80,7 +250,7 @@ func (fw *Writer) Sync() error {
 //   XX variable length data
 //
 //   header:
-//      4 bytes LE len(data) [1] // LE = Little Endian
+//      4 bytes LE len(data) [1] // LE = Little Endian, top 4 bits are flags (e.g. compressed)
 //      4 bytes LE HASH(data)[2] // go-metro
 //      4 bytes MAGIC        [3] // 0xbeef
 //      4 bytes LE HASH(1 2 3)   // hash of the first 12 bytes
@@ -89,49 +259,411 @@ func (fw *Writer) Sync() error {
 //      ..
 // Then the blob(header + data) is padded to PAD size using ((uint32(blobSize) + PAD - 1) / PAD).
 //
+// [1] the top 4 bits of the length are flags, so the stored data is limited to 256MB - 1 (bigger returns EMSGSIZE).
+// Older versions used all 32 bits for the length, so a record of 256MB or more in a file written by them
+// is misread and skipped as corrupted, copy such files with the old version before upgrading.
+//
 // it returns the addressable offset that you can use ReadFromReader() on
 func (fw *Writer) Append(encoded []byte) (uint32, uint32, error) {
-	blobSize := 16 + len(encoded)
-	blob := make([]byte, blobSize)
-	copy(blob[16:], encoded)
-	binary.LittleEndian.PutUint32(blob[0:], uint32(len(encoded)))
-	binary.LittleEndian.PutUint32(blob[4:], uint32(Hash(encoded)))
-	copy(blob[8:], MAGIC)
-	binary.LittleEndian.PutUint32(blob[12:], uint32(Hash(blob[:12])))
+	stored, flags := compress(fw.compression, encoded)
+	return fw.appendStored(stored, flags)
+}
 
-	padded := ((uint32(blobSize) + PAD - 1) / PAD)
+func (fw *Writer) appendStored(stored []byte, flags uint32) (uint32, uint32, error) {
+	if len(stored) > maxRecordSize {
+		return 0, 0, EMSGSIZE
+	}
+	blob := getBlob(16 + len(stored))
+	defer putBlob(blob)
+	fw.format.putFrame(*blob, stored, flags)
 
-	current := atomic.AddUint32(&fw.offset, padded)
-	current -= uint32(padded)
+	padded := fw.format.units(len(stored))
 
-	_, err := fw.file.WriteAt(blob, int64(current*PAD))
+	current, err := fw.reserve(padded)
 	if err != nil {
 		return 0, 0, err
 	}
+
+	_, err = fw.file.WriteAt(*blob, fw.format.position(current))
+	if err != nil {
+		fw.fillHole(current, padded)
+		return 0, 0, err
+	}
 	return uint32(current), current + padded, nil
 }
 
+// AppendV appends one record made of all parts, the same record as Append(bytes.Join(parts, nil)) but without joining them.
+// The parts are hashed incrementally and written together with the header using one pwritev (on linux),
+// elsewhere they are copied once into a pooled buffer. With compression, or with a Hasher that is not a StreamHasher,
+// the parts have to be in one buffer anyway, so they are copied into a pooled one
+func (fw *Writer) AppendV(parts ...[]byte) (uint32, uint32, error) {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+	if size > maxRecordSize {
+		return 0, 0, EMSGSIZE
+	}
+
+	sh, ok := fw.format.hasher.(StreamHasher)
+	if !ok || fw.compression != NoCompression {
+		joined := getBlob(size)
+		defer putBlob(joined)
+		joinInto(*joined, parts)
+		stored, flags := compress(fw.compression, *joined)
+		return fw.appendStored(stored, flags)
+	}
+
+	h, _ := fw.digests.Get().(hash.Hash64)
+	if h == nil {
+		h = sh.New()
+	}
+	h.Reset()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	header := getBlob(16)
+	defer putBlob(header)
+	fw.format.putHeader(*header, uint32(size), 0, uint32(h.Sum64()))
+	fw.digests.Put(h)
+
+	padded := fw.format.units(size)
+	current, err := fw.reserve(padded)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bufs := getBufs()
+	*bufs = append(append((*bufs)[:0], *header), parts...)
+	err = writev(fw.file, *bufs, fw.format.position(current))
+	putBufs(bufs)
+	if err != nil {
+		fw.fillHole(current, padded)
+		return 0, 0, err
+	}
+	return current, current + padded, nil
+}
+
+// bigger blobs are left to the GC, so one huge record does not stay in the pool forever
+const maxPooledBlob = 1 << 20
+
+var blobs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// returns a buffer of size bytes from the pool, the content is garbage
+func getBlob(size int) *[]byte {
+	b := blobs.Get().(*[]byte)
+	if cap(*b) < size {
+		*b = make([]byte, size)
+	}
+	*b = (*b)[:size]
+	return b
+}
+
+func putBlob(b *[]byte) {
+	if cap(*b) <= maxPooledBlob {
+		blobs.Put(b)
+	}
+}
+
+// the header and parts given to writev, bigger slices are left to the GC
+const maxPooledBufs = 1024
+
+var bufsPool = sync.Pool{
+	New: func() interface{} {
+		b := make([][]byte, 0, 16)
+		return &b
+	},
+}
+
+func getBufs() *[][]byte {
+	return bufsPool.Get().(*[][]byte)
+}
+
+func putBufs(b *[][]byte) {
+	if cap(*b) > maxPooledBufs {
+		return
+	}
+	// do not keep the parts alive
+	for i := range *b {
+		(*b)[i] = nil
+	}
+	bufsPool.Put(b)
+}
+
+func joinInto(dst []byte, parts [][]byte) {
+	n := 0
+	for _, p := range parts {
+		n += copy(dst[n:], p)
+	}
+}
+
+// the fallback for writev, all buffers are copied into one and written with WriteAt
+func writeJoined(file *os.File, bufs [][]byte, offset int64) error {
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
+	joined := getBlob(size)
+	defer putBlob(joined)
+	joinInto(*joined, bufs)
+	_, err := file.WriteAt(*joined, offset)
+	return err
+}
+
+// bump pointer allocation of padded units, returns the start of the reserved space
+// instead of wrapping around the 32 bit offset (and overwriting the beginning of the file) it returns EFBIG
+func (fw *Writer) reserve(padded uint32) (uint32, error) {
+	for {
+		current := atomic.LoadUint32(&fw.offset)
+		if uint64(current)+uint64(padded) > math.MaxUint32 {
+			return 0, EFBIG
+		}
+		if atomic.CompareAndSwapUint32(&fw.offset, current, current+padded) {
+			return current, nil
+		}
+	}
+}
+
+// Append and wait until the record is on disk.
+// With WriterOptions.GroupCommit concurrent AppendSync calls share one fsync, otherwise it is just Append followed by Sync
+func (fw *Writer) AppendSync(encoded []byte) (uint32, uint32, error) {
+	off, next, err := fw.Append(encoded)
+	if err != nil {
+		return 0, 0, err
+	}
+	if fw.group != nil {
+		err = fw.group.sync()
+	} else {
+		err = fw.file.Sync()
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return off, next, nil
+}
+
+// AppendBatch appends all records with a single offset reservation and a single WriteAt.
+// Every record is padded the same way as in Append, so each one is readable with ReadFromReader.
+// It is safe to use concurrently with Append, it returns the addressable offset of each record
+func (fw *Writer) AppendBatch(batch [][]byte) ([]uint32, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	total := uint32(0)
+	stored := make([][]byte, len(batch))
+	flags := make([]uint32, len(batch))
+	for i, encoded := range batch {
+		stored[i], flags[i] = compress(fw.compression, encoded)
+		if len(stored[i]) > maxRecordSize {
+			return nil, EMSGSIZE
+		}
+		total += fw.format.units(len(stored[i]))
+	}
+
+	current, err := fw.reserve(total)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make([]uint32, len(batch))
+	blob := make([]byte, fw.format.position(total))
+	end := 0
+	pos := uint32(0)
+	for i, encoded := range stored {
+		start := int(fw.format.position(pos))
+		fw.format.putFrame(blob[start:], encoded, flags[i])
+		offsets[i] = current + pos
+		end = start + 16 + len(encoded)
+		pos += fw.format.units(len(encoded))
+	}
+
+	// no need to write the padding after the last record, same as Append
+	_, err = fw.file.WriteAt(blob[:end], fw.format.position(current))
+	if err != nil {
+		fw.fillHole(current, total)
+		return nil, err
+	}
+	return offsets, nil
+}
+
 // Overwrite specific offset, if the new data is bigger than old data it will return EOVERFLOW
+// (with compression the stored sizes are compared). Space freed by smaller data is marked with a skip record,
+// so scans jump over it instead of reporting it as corrupted
 func (fw *Writer) Overwrite(offset uint32, encoded []byte) error {
-	data, _, err := ReadFromReader(fw.file, offset, 16)
+	stored, flags := compress(fw.compression, encoded)
+	return fw.overwriteStored(offset, stored, flags, nil)
+}
+
+// Overwrite only if the checksum of the stored data still matches expectedHash (get it with ReadWithHash), otherwise returns ESTALE.
+// Calls for the same offset are serialized, so this can be used for optimistic concurrency:
+//
+//	for {
+//		data, hash, err := w.ReadWithHash(offset)
+//		if err != nil {
+//			panic(err)
+//		}
+//		err = w.CompareAndOverwrite(offset, hash, modify(data))
+//		if err == ESTALE {
+//			continue
+//		}
+//		if err != nil {
+//			panic(err)
+//		}
+//		break
+//	}
+func (fw *Writer) CompareAndOverwrite(offset uint32, expectedHash uint32, encoded []byte) error {
+	stored, flags := compress(fw.compression, encoded)
+	return fw.overwriteStored(offset, stored, flags, &expectedHash)
+}
+
+// Read the record at offset, returns the data and the checksum of the stored data to use with CompareAndOverwrite
+func (fw *Writer) ReadWithHash(offset uint32) ([]byte, uint32, error) {
+	lock := fw.lock(offset)
+	lock.Lock()
+	defer lock.Unlock()
+
+	fr, err := fw.liveFrame(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := decompress(fr.data, fr.flags)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, fr.hash, nil
+}
+
+func (fw *Writer) lock(offset uint32) *sync.Mutex {
+	return &fw.locks[offset%uint32(len(fw.locks))]
+}
+
+// reads the frame at offset, it must be a live record
+func (fw *Writer) liveFrame(offset uint32) (frame, error) {
+	fr, err := fw.format.readFrame(fw.file, uint64(fw.format.position(offset)), 16)
+	if err != nil {
+		return frame{}, err
+	}
+	if fr.flags&flagSkip != 0 {
+		return frame{}, EBADSLT
+	}
+	if fr.flags&flagDeleted != 0 {
+		return frame{}, ErrDeleted
+	}
+	return fr, nil
+}
+
+func (fw *Writer) overwriteStored(offset uint32, stored []byte, flags uint32, expectedHash *uint32) error {
+	lock := fw.lock(offset)
+	lock.Lock()
+	defer lock.Unlock()
+
+	old, err := fw.liveFrame(offset)
 	if err != nil {
 		return err
 	}
-	if len(data) < len(encoded) {
+	if expectedHash != nil && old.hash != *expectedHash {
+		return ESTALE
+	}
+	if len(old.data) < len(stored) {
 		return EOVERFLOW
 	}
 
-	blobSize := 16 + len(encoded)
-	blob := make([]byte, blobSize)
-	copy(blob[16:], encoded)
-	binary.LittleEndian.PutUint32(blob[0:], uint32(len(encoded)))
-	binary.LittleEndian.PutUint32(blob[4:], uint32(Hash(encoded)))
-	copy(blob[8:], MAGIC)
-	binary.LittleEndian.PutUint32(blob[12:], uint32(Hash(blob[:12])))
+	blob := fw.format.overwriteBlob(stored, flags, len(old.data))
+	_, err = fw.file.WriteAt(blob, fw.format.position(offset))
+	invalidateCaches(fw.info, offset)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete marks the record as deleted and overwrites its data with zeroes, so the content is really gone from the file.
+// The record keeps its size, Read returns ErrDeleted and Scan skips it (see ScanOptions.OnDeleted).
+// Deleting deleted record is not an error
+func (fw *Writer) Delete(offset uint32) error {
+	lock := fw.lock(offset)
+	lock.Lock()
+	defer lock.Unlock()
 
-	_, err = fw.file.WriteAt(blob, int64(offset*PAD))
+	old, err := fw.format.readFrame(fw.file, uint64(fw.format.position(offset)), 16)
+	if err != nil {
+		return err
+	}
+	if old.flags&flagSkip != 0 {
+		return EBADSLT
+	}
+	if old.flags&flagDeleted != 0 {
+		return nil
+	}
+
+	blob := make([]byte, 16+len(old.data))
+	fw.format.putFrame(blob, blob[16:], flagDeleted)
+
+	_, err = fw.file.WriteAt(blob, fw.format.position(offset))
+	invalidateCaches(fw.info, offset)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// The space for a failed write is already reserved, and appends after it were possibly written already,
+// so mark it with skip records to let the readers jump over it in one read instead of resyncing over it.
+// Best effort, if this fails too the readers still resync.
+func (fw *Writer) fillHole(offset uint32, units uint32) {
+	header := make([]byte, 16)
+	for units > 0 {
+		n := units
+		if n > maxRecordSize {
+			n = maxRecordSize
+		}
+		fw.format.putSkip(header, n)
+		_, err := fw.file.WriteAt(header, fw.format.position(offset))
+		if err != nil {
+			return
+		}
+		offset += n
+		units -= n
+	}
+}
+
+// the frame replacing a record that had oldLength stored bytes. If it needs fewer units the freed ones
+// are covered with a skip record in the same write, otherwise scans would see the stale bytes as corruption
+func (f *format) overwriteBlob(stored []byte, flags uint32, oldLength int) []byte {
+	units := f.units(len(stored))
+	freed := f.units(oldLength) - units
+	if freed == 0 {
+		blob := make([]byte, 16+len(stored))
+		f.putFrame(blob, stored, flags)
+		return blob
+	}
+	blob := make([]byte, int(units*f.pad)+16)
+	f.putFrame(blob, stored, flags)
+	f.putSkip(blob[units*f.pad:], freed)
+	return blob
+}
+
+// writes skip record header, the length is how many pad units to jump, and there is no data
+func (f *format) putSkip(header []byte, units uint32) {
+	f.putHeader(header, units, flagSkip, 0)
+}
+
+// writes the header followed by the data into blob, blob must be at least 16 + len(stored) long
+// the checksum is of the stored bytes, so corruption is caught before decompressing
+func (f *format) putFrame(blob []byte, stored []byte, flags uint32) {
+	copy(blob[16:], stored)
+	f.putHeader(blob, uint32(len(stored)), flags, uint32(f.hasher.Sum64(stored)))
+}
+
+func (f *format) putHeader(header []byte, length uint32, flags uint32, dataHash uint32) {
+	binary.LittleEndian.PutUint32(header[0:], length|flags)
+	binary.LittleEndian.PutUint32(header[4:], dataHash)
+	copy(header[8:], f.magic)
+	binary.LittleEndian.PutUint32(header[12:], uint32(f.hasher.Sum64(header[:12])))
+}
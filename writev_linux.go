@@ -0,0 +1,98 @@
+package pen
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// IOV_MAX
+const maxIovecs = 1024
+
+// state of one writev, pooled with the callback for RawConn.Write so a call does not allocate them
+type pwritev struct {
+	iovecs []syscall.Iovec
+	offset int64
+	n      uintptr
+	errno  syscall.Errno
+	write  func(fd uintptr) bool
+}
+
+var pwritevs = sync.Pool{
+	New: func() interface{} {
+		p := &pwritev{iovecs: make([]syscall.Iovec, 0, 16)}
+		p.write = p.call
+		return p
+	},
+}
+
+func (p *pwritev) call(fd uintptr) bool {
+	for {
+		// the offset is split in low and high half for 32 bit platforms, on 64 bit the high half is ignored
+		p.n, _, p.errno = syscall.Syscall6(syscall.SYS_PWRITEV, fd, uintptr(unsafe.Pointer(&p.iovecs[0])), uintptr(len(p.iovecs)), uintptr(p.offset), uintptr(uint64(p.offset)>>32), 0)
+		if p.errno != syscall.EINTR {
+			return true
+		}
+	}
+}
+
+// writes all buffers at offset with pwritev, so they do not have to be copied into one
+func writev(file *os.File, bufs [][]byte, offset int64) error {
+	if len(bufs) > maxIovecs {
+		return writeJoined(file, bufs, offset)
+	}
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	p := pwritevs.Get().(*pwritev)
+	defer func() {
+		// do not keep the buffers alive
+		for i := range p.iovecs {
+			p.iovecs[i] = syscall.Iovec{}
+		}
+		pwritevs.Put(p)
+	}()
+
+	p.offset = offset
+	for {
+		p.iovecs = p.iovecs[:0]
+		for _, b := range bufs {
+			if len(b) == 0 {
+				continue
+			}
+			v := syscall.Iovec{Base: &b[0]}
+			v.SetLen(len(b))
+			p.iovecs = append(p.iovecs, v)
+		}
+		if len(p.iovecs) == 0 {
+			return nil
+		}
+
+		err = rc.Write(p.write)
+		if err != nil {
+			return err
+		}
+		if p.errno != 0 {
+			return &os.PathError{Op: "pwritev", Path: file.Name(), Err: p.errno}
+		}
+		n := p.n
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+
+		// short write, continue with the rest
+		p.offset += int64(n)
+		for n > 0 {
+			if uintptr(len(bufs[0])) > n {
+				bufs[0] = bufs[0][n:]
+				break
+			}
+			n -= uintptr(len(bufs[0]))
+			bufs = bufs[1:]
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package pen
+
+import "os"
+
+func writev(file *os.File, bufs [][]byte, offset int64) error {
+	return writeJoined(file, bufs, offset)
+}